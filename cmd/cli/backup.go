@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var backupCommand = &command{
+	Name:    "backup",
+	Usage:   "[--set <name>] [--tag <tags>] [--description <text>]",
+	Summary: "take a new snapshot of the backup set source",
+	Run:     runBackup,
+}
+
+func runBackup(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	tags := flags.String("tag", "", "comma-separated tags of the new snapshot")
+	description := flags.String("description", "", "description of the new snapshot")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	snapshotter, err := backup.NewSnapshotter(backupSet, backup.SnapshotOptions{
+		Tags:        splitList(*tags),
+		Description: *description,
+	})
+	if err != nil {
+		return err
+	}
+	return snapshotter.TakeSnapshot()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var checkCommand = &command{
+	Name:    "check",
+	Usage:   "[--set <name>] [--read-data | --read-data-subset <n>%] [--json]",
+	Summary: "verify snapshot indexes, the blob index and all referenced blobs",
+	Run:     runCheck,
+}
+
+func runCheck(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	readData := flags.Bool("read-data", false, "read all referenced blobs and verify their content")
+	readDataSubset := flags.String("read-data-subset", "", "read a random percentage of referenced blobs, e.g. 10%")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	var opts backup.CheckOptions
+	if *readData {
+		opts.ReadDataFraction = 1
+	}
+	if len(*readDataSubset) > 0 {
+		if *readData {
+			return newUsageError("--read-data and --read-data-subset are mutually exclusive")
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(*readDataSubset, "%"), 64)
+		if err != nil || !strings.HasSuffix(*readDataSubset, "%") || percent <= 0 || percent > 100 {
+			return newUsageError("invalid --read-data-subset %q, expected a percentage like 10%%", *readDataSubset)
+		}
+		opts.ReadDataFraction = percent / 100
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	reports, err := backupSet.Check(opts)
+
+	var errCount int
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+	}
+	for i, report := range reports {
+		errCount += len(report.Errors)
+		if *asJSON {
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println("destination:     ", report.Destination)
+		fmt.Println("snapshots:       ", report.Snapshots)
+		fmt.Println("referenced blobs:", report.ReferencedBlobs)
+		fmt.Println("indexed blobs:   ", report.IndexedBlobs)
+		fmt.Println("stored blobs:    ", report.StoredBlobs)
+		fmt.Println("read blobs:      ", report.ReadBlobs)
+		for _, checkErr := range report.Errors {
+			fmt.Printf("ERR: %s: %s\n", checkErr.Path, checkErr.Message)
+		}
+		for _, warning := range report.Warnings {
+			fmt.Printf("WARN: %s: %s (run 'keepr prune' to remove it)\n", warning.Path, warning.Message)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	if errCount > 0 {
+		return fmt.Errorf("repository has %d errors", errCount)
+	}
+	if !*asJSON {
+		fmt.Println("no errors found")
+	}
+	return nil
+}
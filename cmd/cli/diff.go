@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var diffCommand = &command{
+	Name:    "diff",
+	Usage:   "[--set <name>] [--json] <snapshot-a> <snapshot-b>",
+	Summary: "show added, removed, modified and renamed files between two snapshots",
+	Run:     runDiff,
+}
+
+func runDiff(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	asJSON := flags.Bool("json", false, "print the diff as JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return newUsageError("expected two snapshots")
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	a, err := backupSet.FindSnapshot(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := backupSet.FindSnapshot(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range []*backup.Snapshot{a, b} {
+		if err := backupSet.LoadSnapshotFiles(snapshot); err != nil {
+			return err
+		}
+	}
+
+	diff := backup.DiffSnapshots(a, b)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+
+	for _, f := range diff.Added {
+		fmt.Printf("+ %s (%s)\n", f.Path, formatSize(f.NewSize))
+	}
+	for _, f := range diff.Removed {
+		fmt.Printf("- %s (%s)\n", f.Path, formatSize(f.OldSize))
+	}
+	for _, f := range diff.Modified {
+		fmt.Printf("M %s (%s -> %s, %s)\n", f.Path, formatSize(f.OldSize), formatSize(f.NewSize), formatSizeDelta(f.SizeDelta))
+	}
+	for _, f := range diff.Renamed {
+		fmt.Printf("R %s -> %s (%s)\n", f.OldPath, f.NewPath, formatSize(f.Size))
+	}
+	fmt.Printf("\n%d added, %d removed, %d modified, %d renamed, total size %s\n", len(diff.Added), len(diff.Removed), len(diff.Modified), len(diff.Renamed), formatSizeDelta(diff.SizeDelta))
+	return nil
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(uint64(-delta))
+	}
+	return "+" + formatSize(uint64(delta))
+}
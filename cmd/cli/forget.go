@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var forgetCommand = &command{
+	Name:    "forget",
+	Usage:   "[--set <name>] [--dry-run]",
+	Summary: "remove snapshots according to the retention policy of the backup set",
+	Run:     runForget,
+}
+
+func runForget(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	dryRun := flags.Bool("dry-run", false, "only list the snapshots that would be removed")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := backupSet.ListSnapshots()
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+
+	decisions, err := backup.ApplyRetentionPolicy(snapshots, backupSet.RetentionPolicy())
+	if err != nil {
+		return fmt.Errorf("backup set %q: %w", backupSet.Name(), err)
+	}
+
+	forget := make([]*backup.Snapshot, 0)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tACTION\tREASONS")
+	for _, decision := range decisions {
+		action := "keep"
+		if !decision.Keep {
+			action = "forget"
+			forget = append(forget, decision.Snapshot)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", decision.Snapshot.ShortName(), decision.Snapshot.CreatedAt.Local().Format(time.DateTime), action, strings.Join(decision.Reasons, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Println("dry run:", len(forget), "snapshots would be removed")
+		return nil
+	}
+	if err := backupSet.ForgetSnapshots(forget); err != nil {
+		return err
+	}
+	fmt.Println("removed", len(forget), "snapshots")
+	return nil
+}
@@ -1,55 +1,185 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/sbreitf1/keepr/internal/backup"
 	"github.com/sbreitf1/keepr/internal/config"
-	"github.com/sbreitf1/keepr/internal/serve"
 )
 
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type command struct {
+	Name    string
+	Usage   string
+	Summary string
+	Run     func(cmd *command, args []string) error
+}
+
+var commands = []*command{
+	backupCommand,
+	snapshotsCommand,
+	tagCommand,
+	serveCommand,
+	restoreCommand,
+	diffCommand,
+	forgetCommand,
+	pruneCommand,
+	checkCommand,
+	unlockCommand,
+}
+
+// usageError is returned by commands when the arguments are invalid.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func newUsageError(format string, args ...any) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
 func main() {
-	backupSets, err := config.LoadBackupSets()
-	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
 	}
-	snapshots, err := backupSets[0].ListSnapshots()
-	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				cmd.Run(cmd, []string{"-h"})
+				return exitOK
+			}
+			fmt.Fprintf(os.Stderr, "ERR: unknown command %q\n", args[1])
+			return exitUsage
+		}
+		printUsage(os.Stdout)
+		return exitOK
 	}
-	fmt.Println("serve", snapshots[len(snapshots)-1].CreatedAt)
-	browser, err := backup.NewBrowser(backupSets[0], snapshots[len(snapshots)-1])
-	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "ERR: unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
 	}
 
-	/*r, err := browser.OpenFile("cnc2.png")
-	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+	if err := cmd.Run(cmd, args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		var uerr *usageError
+		if errors.As(err, &uerr) {
+			fmt.Fprintln(os.Stderr, "ERR:", uerr.msg)
+			fmt.Fprintf(os.Stderr, "run 'keepr help %s' for usage\n", cmd.Name)
+			return exitUsage
+		}
+		fmt.Fprintln(os.Stderr, "ERR:", err)
+		return exitError
 	}
-	buf := make([]byte, 10*1024*1024)
-	n, err := r.Read(buf)
-	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+	return exitOK
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "keepr - incremental, deduplicating backups")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "usage: keepr <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Summary)
 	}
-	fmt.Println(n)
-	fmt.Println(os.WriteFile("G:\\Backup\\keepr-local-test\\cnc2.png", buf[:n], os.ModePerm))*/
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run 'keepr help <command>' for details on a command")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "exit codes:")
+	fmt.Fprintln(w, "  0  success")
+	fmt.Fprintln(w, "  1  the command failed")
+	fmt.Fprintln(w, "  2  invalid usage")
+}
+
+func printCommandUsage(w io.Writer, cmd *command, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: keepr %s %s\n\n", cmd.Name, cmd.Usage)
+	fmt.Fprintln(w, cmd.Summary)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "flags:")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
 
-	//fmt.Println(browser.GetFile("cnc2.png"))
+// newFlagSet creates the flag set for a command. Parse errors are reported by the caller and help output is written to stdout.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {
+		printCommandUsage(os.Stdout, cmd, flags)
+	}
+	return flags
+}
 
-	fmt.Println(serve.ServeWebDAV(browser))
-	//fmt.Println(mirror.ServeWebDAV("G:\\Eigene Dateien\\Eigene Bilder\\Spiele"))
+// parseFlags parses args into flags and converts parse errors into usage errors.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{msg: err.Error()}
+	}
+	return nil
+}
 
-	/*snapshotter, err := backup.NewSnapshotter(backupSets[0])
+// selectBackupSet returns the backup set with the given name. An empty name is only allowed if exactly one backup set is configured.
+func selectBackupSet(name string) (*backup.BackupSet, error) {
+	backupSets, err := config.LoadBackupSets()
 	if err != nil {
-		fmt.Println("ERR:", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("load backup sets: %w", err)
+	}
+	if len(backupSets) == 0 {
+		return nil, fmt.Errorf("no backup sets configured")
+	}
+
+	if len(name) == 0 {
+		if len(backupSets) > 1 {
+			names := make([]string, 0, len(backupSets))
+			for _, set := range backupSets {
+				names = append(names, set.Name())
+			}
+			return nil, newUsageError("multiple backup sets configured, select one with --set (%s)", strings.Join(names, ", "))
+		}
+		return backupSets[0], nil
+	}
+
+	for _, set := range backupSets {
+		if set.Name() == name {
+			return set, nil
+		}
 	}
-	fmt.Println(snapshotter.TakeSnapshot())*/
+	return nil, newUsageError("unknown backup set %q", name)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+)
+
+var pruneCommand = &command{
+	Name:    "prune",
+	Usage:   "[--set <name>] [--dry-run]",
+	Summary: "remove blobs that are no longer referenced by any snapshot",
+	Run:     runPrune,
+}
+
+func runPrune(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	results, err := backupSet.Prune(*dryRun)
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	for i, result := range results {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println("destination", result.Destination+":")
+		fmt.Println(result.ReferencedBlobs, "blobs are referenced by snapshots")
+		fmt.Printf("%s %d unreferenced blobs (%s)\n", verb, result.UnreferencedBlobs, formatSize(result.ReclaimableBytes))
+		if result.UnindexedBlobs > 0 {
+			fmt.Println(result.UnindexedBlobs, "of them are not listed in the blob index")
+		}
+		fmt.Println(verb, result.RemovedDirs, "empty directories")
+		if result.RemovedTempFiles > 0 {
+			fmt.Println(verb, result.RemovedTempFiles, "temporary files of interrupted writes")
+		}
+		if result.RemovedIncompleteSnapshots > 0 {
+			fmt.Println(verb, result.RemovedIncompleteSnapshots, "incomplete snapshots of interrupted backups")
+		}
+	}
+	return err
+}
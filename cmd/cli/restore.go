@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var restoreCommand = &command{
+	Name:    "restore",
+	Usage:   "[--set <name>] [--path <path>] [--overwrite] [--xattrs] <snapshot> <target-dir>",
+	Summary: "restore a snapshot or a part of it into a local directory",
+	Run:     runRestore,
+}
+
+func runRestore(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	path := flags.String("path", "", "only restore this file or directory of the snapshot")
+	overwrite := flags.Bool("overwrite", false, "overwrite existing files in the target directory")
+	xattrs := flags.Bool("xattrs", false, "restore extended attributes and POSIX ACLs")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return newUsageError("expected snapshot and target directory")
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := backupSet.FindSnapshot(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	browser, err := backup.NewBrowser(backupSet, snapshot)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer browser.Close()
+
+	if err := browser.Restore(flags.Arg(1), backup.RestoreOptions{
+		Path:      *path,
+		Overwrite: *overwrite,
+		Xattrs:    *xattrs,
+	}); err != nil {
+		return err
+	}
+	fmt.Println("restored snapshot", snapshot.ShortName(), "to", flags.Arg(1))
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+	"github.com/sbreitf1/keepr/internal/serve"
+)
+
+var serveCommand = &command{
+	Name:    "serve",
+	Usage:   "[--set <name>] [--listen <addr>] [<snapshot>]",
+	Summary: "serve a snapshot read-only via WebDAV (defaults to the latest snapshot)",
+	Run:     runServe,
+}
+
+func runServe(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	listenAddr := flags.String("listen", "127.0.0.1:8080", "address of the WebDAV server")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return newUsageError("unexpected arguments %v", flags.Args()[1:])
+	}
+	snapshotName := "latest"
+	if flags.NArg() == 1 {
+		snapshotName = flags.Arg(0)
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := backupSet.FindSnapshot(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	browser, err := backup.NewBrowser(backupSet, snapshot)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer browser.Close()
+
+	fmt.Printf("serving snapshot %s of %s on http://%s\n", snapshot.ShortName(), backupSet.Name(), *listenAddr)
+	return serve.ServeWebDAV(browser, *listenAddr)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup"
+)
+
+var snapshotsCommand = &command{
+	Name:    "snapshots",
+	Usage:   "[--set <name>] [--host <hostname>] [--user <username>] [--path <path>] [--tag <tags>]",
+	Summary: "list the snapshots of a backup set",
+	Run:     runSnapshots,
+}
+
+func runSnapshots(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	host := flags.String("host", "", "only list snapshots taken on this host")
+	username := flags.String("user", "", "only list snapshots taken by this user")
+	path := flags.String("path", "", "only list snapshots of this source path or a directory below it")
+	tags := flags.String("tag", "", "only list snapshots with all of these comma-separated tags")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := backupSet.ListSnapshots()
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+	snapshots = backup.FilterSnapshots(snapshots, backup.SnapshotFilter{
+		Hostname:   *host,
+		Username:   *username,
+		SourcePath: *path,
+		Tags:       splitList(*tags),
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tHOST\tFILES\tSIZE\tTAGS\tDESCRIPTION")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", snapshot.ShortName(), snapshot.CreatedAt.Local().Format(time.DateTime), snapshot.Hostname, snapshot.FileCount, formatSize(snapshot.TotalSize), strings.Join(snapshot.Tags, ","), snapshot.Description)
+	}
+	return w.Flush()
+}
+
+func formatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
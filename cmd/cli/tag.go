@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var tagCommand = &command{
+	Name:    "tag",
+	Usage:   "[--set <name>] [--add <tags>] [--remove <tags>] <snapshot>...",
+	Summary: "add or remove tags of existing snapshots",
+	Run:     runTag,
+}
+
+func runTag(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	add := flags.String("add", "", "comma-separated tags to add")
+	remove := flags.String("remove", "", "comma-separated tags to remove")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return newUsageError("expected at least one snapshot")
+	}
+	if len(*add) == 0 && len(*remove) == 0 {
+		return newUsageError("expected --add or --remove")
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range flags.Args() {
+		snapshot, err := backupSet.FindSnapshot(name)
+		if err != nil {
+			return err
+		}
+		if err := backupSet.TagSnapshot(snapshot, splitList(*add), splitList(*remove)); err != nil {
+			return fmt.Errorf("tag snapshot %s: %w", snapshot.ShortName(), err)
+		}
+		fmt.Println("snapshot", snapshot.ShortName(), "is tagged with", "["+strings.Join(snapshot.Tags, ",")+"]")
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value. An empty value results in an empty list.
+func splitList(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+)
+
+var unlockCommand = &command{
+	Name:    "unlock",
+	Usage:   "[--set <name>] [--all]",
+	Summary: "remove stale locks left behind by crashed keepr processes",
+	Run:     runUnlock,
+}
+
+func runUnlock(cmd *command, args []string) error {
+	flags := newFlagSet(cmd)
+	setName := flags.String("set", "", "name of the backup set")
+	all := flags.Bool("all", false, "also remove locks of running processes")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("unexpected arguments %v", flags.Args())
+	}
+
+	backupSet, err := selectBackupSet(*setName)
+	if err != nil {
+		return err
+	}
+
+	removed, err := backupSet.Unlock(*all)
+	for _, lock := range removed {
+		fmt.Println("removed", lock.String())
+	}
+	if err == nil && len(removed) == 0 {
+		fmt.Println("no stale locks found")
+	}
+	return err
+}
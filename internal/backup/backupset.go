@@ -1,144 +1,336 @@
-package backup
-
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-
-	"github.com/sbreitf1/keepr/internal/backup/destination"
-)
-
-type BackupSetConfig struct {
-	Name         string
-	Encryption   BackupSetEncryptionConfig
-	Source       BackupSourceLocalDirConfig
-	Destinations []destination.Config
-}
-
-type BackupSetEncryptionConfig struct {
-	Enabled      bool
-	PasswordHash [32]byte
-	PasswordSalt []byte
-}
-
-type BackupSourceConfig struct {
-	Name     string
-	LocalDir BackupSourceLocalDirConfig
-}
-
-type BackupSourceLocalDirConfig struct {
-	Path         string
-	ExcludePaths []string
-}
-
-type BackupSet struct {
-	conf BackupSetConfig
-}
-
-func NewBackupSetFromConfig(conf BackupSetConfig) (*BackupSet, error) {
-	//TODO validate config
-
-	return &BackupSet{conf: conf}, nil
-}
-
-func (backupSet *BackupSet) OpenDestination() (destination.Interface, error) {
-	dest, err := destination.NewLocalDir(backupSet.conf.Destinations[0].LocalFileSystem)
-	if err != nil {
-		return nil, fmt.Errorf("init local dir destination: %w", err)
-	}
-	return dest, nil
-}
-
-/*func (backupSet *BackupSet) SetPassword(password string) {
-	backupSet.conf.PasswordSalt = make([]byte, 64)
-	if _, err := rand.Read(backupSet.conf.PasswordSalt); err != nil {
-		panic(err)
-	}
-	backupSet.conf.PasswordHash = backupSet.computeHash(password)
-}
-
-func (backupSet *BackupSet) CheckPassword(password string) bool {
-	return backupSet.computeHash(password) == backupSet.conf.PasswordHash
-}
-
-func (backupSet *BackupSet) computeHash(password string) [32]byte {
-	hasher := sha256.New()
-	hasher.Write(backupSet.conf.PasswordSalt)
-	hasher.Write([]byte(password))
-	return [32]byte(hasher.Sum(nil))
-}*/
-
-type BlobID [32]byte
-
-func (id BlobID) String() string {
-	return fmt.Sprintf("%x", [32]byte(id))
-}
-
-type blobLen uint32
-
-func (backupSet *BackupSet) ReadBlobIndex(dest destination.Interface) (map[BlobID]blobLen, error) {
-	data, err := dest.ReadFile(".blob-index")
-	if err != nil {
-		if dest.IsNotExists(err) {
-			return make(map[BlobID]blobLen), nil
-		}
-		return nil, err
-	}
-
-	r := bytes.NewReader(data)
-	version, err := r.ReadByte()
-	if version != 0 {
-		return nil, fmt.Errorf("unsupported blob index version %d", version)
-	}
-
-	var blobCount uint32
-	if err := binary.Read(r, binary.LittleEndian, &blobCount); err != nil {
-		return nil, err
-	}
-
-	blobs := make(map[BlobID]blobLen, blobCount)
-	for range blobCount {
-		var blobID BlobID
-		if err := binary.Read(r, binary.LittleEndian, &blobID); err != nil {
-			return nil, err
-		}
-		var blobLen blobLen
-		if err := binary.Read(r, binary.LittleEndian, &blobLen); err != nil {
-			return nil, err
-		}
-		blobs[blobID] = blobLen
-	}
-
-	return blobs, nil
-}
-
-func (backupSet *BackupSet) WriteBlobIndex(dest destination.Interface, blobs map[BlobID]blobLen) error {
-	w := bytes.NewBuffer(nil)
-
-	// version
-	if err := w.WriteByte(0); err != nil {
-		return err
-	}
-
-	if err := binary.Write(w, binary.LittleEndian, uint32(len(blobs))); err != nil {
-		return err
-	}
-	for id, blobLen := range blobs {
-		if _, err := w.Write(id[:]); err != nil {
-			return err
-		}
-		if err := binary.Write(w, binary.LittleEndian, blobLen); err != nil {
-			return err
-		}
-	}
-
-	return dest.WriteFile(".blob-index", w.Bytes())
-}
-
-func (backupSet *BackupSet) ListSnapshots() ([]*Snapshot, error) {
-	dest, err := backupSet.OpenDestination()
-	if err != nil {
-		return nil, err
-	}
-	return ListSnapshots(&snapshotContext{dest: dest})
-}
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+	"github.com/sbreitf1/keepr/internal/ratelimit"
+)
+
+type BackupSetConfig struct {
+	Name         string
+	Encryption   BackupSetEncryptionConfig
+	Compression  BackupSetCompressionConfig
+	Chunker      BackupSetChunkerConfig
+	Source       BackupSourceLocalDirConfig
+	Destinations []destination.Config
+	Retention    RetentionPolicyConfig
+	Cache        BackupSetCacheConfig
+}
+
+type BackupSetEncryptionConfig struct {
+	Enabled bool
+	// PasswordFile contains the password, if it is not given via KEEPR_PASSWORD.
+	PasswordFile string
+}
+
+type BackupSourceConfig struct {
+	Name     string
+	LocalDir BackupSourceLocalDirConfig
+}
+
+type BackupSourceLocalDirConfig struct {
+	Path         string
+	ExcludePaths []string
+	// RateLimit limits reading files during backups, so other programs can still use the disk.
+	RateLimit *BackupSourceRateLimitConfig `json:",omitempty"`
+}
+
+// BackupSourceRateLimitConfig limits the read rate in bytes per second, 0 is unlimited.
+type BackupSourceRateLimitConfig struct {
+	Read int64
+	// Schedule overrides the rate during periods of the day. The first matching period is used.
+	Schedule []BackupSourceRateLimitPeriodConfig
+}
+
+type BackupSourceRateLimitPeriodConfig struct {
+	// From and To are given in local time like "22:00". A period that ends before it starts spans midnight.
+	From string
+	To   string
+	Read int64
+}
+
+// newLimiter returns nil if reads are not limited.
+func (conf *BackupSourceRateLimitConfig) newLimiter() (*ratelimit.Limiter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	if conf.Read < 0 {
+		return nil, fmt.Errorf("rate must not be negative")
+	}
+	rates := make([]ratelimit.ScheduledRate, 0, len(conf.Schedule))
+	for i, periodConf := range conf.Schedule {
+		period, err := ratelimit.ParsePeriod(periodConf.From, periodConf.To)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %w", i+1, err)
+		}
+		if periodConf.Read < 0 {
+			return nil, fmt.Errorf("schedule %d: rate must not be negative", i+1)
+		}
+		rates = append(rates, ratelimit.ScheduledRate{Period: period, Rate: periodConf.Read})
+	}
+	rate := ratelimit.Schedule(conf.Read, rates)
+	if rate == nil {
+		return nil, nil
+	}
+	return ratelimit.NewLimiter(rate), nil
+}
+
+type BackupSet struct {
+	conf     BackupSetConfig
+	password string
+}
+
+func NewBackupSetFromConfig(conf BackupSetConfig) (*BackupSet, error) {
+	//TODO validate config
+
+	return &BackupSet{conf: conf}, nil
+}
+
+func (backupSet *BackupSet) Name() string {
+	return backupSet.conf.Name
+}
+
+func (backupSet *BackupSet) RetentionPolicy() RetentionPolicyConfig {
+	return backupSet.conf.Retention
+}
+
+// OpenDestination returns all reachable destinations of the backup set combined into one. Reads fall back to the next destination if one fails. Unreachable destinations are only reported as warning, so it must not be used for operations that modify the repository.
+func (backupSet *BackupSet) OpenDestination() (destination.Interface, error) {
+	if len(backupSet.conf.Destinations) == 0 {
+		return nil, fmt.Errorf("missing destination")
+	}
+	dests, errs := backupSet.OpenDestinations()
+	reachable := make([]destination.Interface, 0, len(dests))
+	for i, dest := range dests {
+		if errs[i] != nil {
+			fmt.Println("WARN: destination", backupSet.conf.Destinations[i], "is unreachable:", errs[i])
+			continue
+		}
+		reachable = append(reachable, dest)
+	}
+	if len(reachable) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(reachable) == 1 {
+		return reachable[0], nil
+	}
+	mirror, err := destination.NewMirror(reachable)
+	if err != nil {
+		closeDestinations(reachable)
+		return nil, err
+	}
+	return mirror, nil
+}
+
+// OpenDestinations opens all destinations of the backup set. The returned slices contain either the destination or the error for each configured destination.
+func (backupSet *BackupSet) OpenDestinations() ([]destination.Interface, []error) {
+	dests := make([]destination.Interface, len(backupSet.conf.Destinations))
+	errs := make([]error, len(backupSet.conf.Destinations))
+	for i, conf := range backupSet.conf.Destinations {
+		dests[i], errs[i] = conf.Open()
+	}
+	return dests, errs
+}
+
+// openAllDestinations opens all destinations of the backup set for operations that modify the repository. It fails if any destination is unreachable, because changing only some of them would let the destinations diverge.
+func (backupSet *BackupSet) openAllDestinations() ([]destination.Interface, error) {
+	if len(backupSet.conf.Destinations) == 0 {
+		return nil, fmt.Errorf("missing destination")
+	}
+	dests, openErrs := backupSet.OpenDestinations()
+	var errs []error
+	for i, err := range openErrs {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s is unreachable: %w", backupSet.conf.Destinations[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		closeDestinations(dests)
+		return nil, errors.Join(errs...)
+	}
+	return dests, nil
+}
+
+// closeDestinations closes all opened destinations. Entries of destinations that could not be opened are nil.
+func closeDestinations(dests []destination.Interface) {
+	for _, dest := range dests {
+		if dest != nil {
+			dest.Close()
+		}
+	}
+}
+
+type BlobID [32]byte
+
+func (id BlobID) String() string {
+	return fmt.Sprintf("%x", [32]byte(id))
+}
+
+func ParseBlobID(str string) (BlobID, error) {
+	data, err := hex.DecodeString(str)
+	if err != nil {
+		return BlobID{}, err
+	}
+	if len(data) != len(BlobID{}) {
+		return BlobID{}, fmt.Errorf("blob id must be %d bytes long", len(BlobID{}))
+	}
+	return BlobID(data), nil
+}
+
+type blobLen uint32
+
+func (backupSet *BackupSet) ReadBlobIndex(dest destination.Interface) (map[BlobID]blobLen, error) {
+	data, err := dest.ReadFile(".blob-index")
+	if err != nil {
+		if dest.IsNotExists(err) {
+			return make(map[BlobID]blobLen), nil
+		}
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if version != 0 {
+		return nil, fmt.Errorf("unsupported blob index version %d", version)
+	}
+
+	var blobCount uint32
+	if err := binary.Read(r, binary.LittleEndian, &blobCount); err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[BlobID]blobLen, blobCount)
+	for range blobCount {
+		var blobID BlobID
+		if err := binary.Read(r, binary.LittleEndian, &blobID); err != nil {
+			return nil, err
+		}
+		var blobLen blobLen
+		if err := binary.Read(r, binary.LittleEndian, &blobLen); err != nil {
+			return nil, err
+		}
+		blobs[blobID] = blobLen
+	}
+
+	return blobs, nil
+}
+
+// readMergedBlobIndex reads the blob index of dest. The indexes of mirrored destinations are merged, so blobs that are missing on one destination are still known.
+func (backupSet *BackupSet) readMergedBlobIndex(dest destination.Interface) (map[BlobID]blobLen, error) {
+	mirror, ok := dest.(*destination.Mirror)
+	if !ok {
+		return backupSet.ReadBlobIndex(dest)
+	}
+
+	blobs := make(map[BlobID]blobLen)
+	var errs []error
+	for _, d := range mirror.Destinations() {
+		destBlobs, err := backupSet.ReadBlobIndex(d)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for id, blobLen := range destBlobs {
+			blobs[id] = blobLen
+		}
+	}
+	if len(errs) == len(mirror.Destinations()) {
+		return nil, errors.Join(errs...)
+	}
+	return blobs, nil
+}
+
+func (backupSet *BackupSet) WriteBlobIndex(dest destination.Interface, blobs map[BlobID]blobLen) error {
+	w := bytes.NewBuffer(nil)
+
+	// version
+	if err := w.WriteByte(0); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(blobs))); err != nil {
+		return err
+	}
+	for id, blobLen := range blobs {
+		if _, err := w.Write(id[:]); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, blobLen); err != nil {
+			return err
+		}
+	}
+
+	return dest.WriteFile(".blob-index", w.Bytes())
+}
+
+func (backupSet *BackupSet) ListSnapshots() ([]*Snapshot, error) {
+	dest, err := backupSet.OpenDestination()
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	return ListSnapshots(&snapshotContext{dest: dest})
+}
+
+// FindSnapshot returns the snapshot with the given name or a unique prefix of its ID. The special name "latest" selects the most recent snapshot.
+func (backupSet *BackupSet) FindSnapshot(name string) (*Snapshot, error) {
+	snapshots, err := backupSet.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("backup set %q has no snapshots", backupSet.conf.Name)
+	}
+	if name == "latest" {
+		return snapshots[len(snapshots)-1], nil
+	}
+	var matches []*Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+		if isSnapshotID(snapshot.Name) && len(name) > 0 && strings.HasPrefix(snapshot.Name, name) {
+			matches = append(matches, snapshot)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("snapshot %q not found", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("snapshot ID prefix %q is ambiguous, it matches %d snapshots", name, len(matches))
+	}
+}
+
+// LoadSnapshotFiles reads all entries of a snapshot into snapshot.Files. Snapshots with a root tree are listed without their entries, because they are stored in trees.
+func (backupSet *BackupSet) LoadSnapshotFiles(snapshot *Snapshot) error {
+	if snapshot.Files != nil {
+		return nil
+	}
+	dest, err := backupSet.OpenDestination()
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	lock, err := lockRepository(dest, LockShared, "read")
+	if err != nil {
+		return fmt.Errorf("lock repository: %w", err)
+	}
+	defer lock.Unlock()
+
+	key, err := backupSet.openRepositoryKey(dest, false)
+	if err != nil {
+		return fmt.Errorf("open repository key: %w", err)
+	}
+	if err := snapshot.loadFiles(dest, key); err != nil {
+		return fmt.Errorf("read trees of snapshot %s: %w", snapshot.ShortName(), err)
+	}
+	return nil
+}
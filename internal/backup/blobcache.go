@@ -0,0 +1,296 @@
+package backup
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+type BackupSetCacheConfig struct {
+	// MemorySize limits the decoded blobs kept in memory in bytes and defaults to 256 MiB.
+	MemorySize int64
+	// DiskSize enables a second cache tier on disk with the given size in bytes. It is not used for encrypted backup sets, because cached blobs are stored decoded.
+	DiskSize int64
+	// DiskDir defaults to keepr/blobs in the XDG cache dir. Blobs are identified by their content, so the directory can be shared by all backup sets.
+	DiskDir string
+}
+
+const defaultCacheMemorySize = 256 << 20
+
+// blobCache keeps decoded blobs in memory and optionally on disk. It is safe for concurrent use, concurrent requests for the same blob wait for a single load.
+type blobCache struct {
+	mu          sync.Mutex
+	maxSize     int64
+	size        int64
+	lru         *list.List
+	entries     map[BlobID]*list.Element
+	loading     map[BlobID]*blobCacheLoad
+	disk        *diskBlobCache
+	destLoads   int
+	memoryHits  int
+	diskHits    int
+	sharedLoads int
+}
+
+type blobCacheEntry struct {
+	id   BlobID
+	data []byte
+}
+
+type blobCacheLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newBlobCache(conf BackupSetCacheConfig, encrypted bool) (*blobCache, error) {
+	c := &blobCache{
+		maxSize: conf.MemorySize,
+		lru:     list.New(),
+		entries: make(map[BlobID]*list.Element),
+		loading: make(map[BlobID]*blobCacheLoad),
+	}
+	if c.maxSize == 0 {
+		c.maxSize = defaultCacheMemorySize
+	}
+	if conf.DiskSize > 0 && !encrypted {
+		dir := conf.DiskDir
+		if len(dir) == 0 {
+			dir = filepath.Join(xdg.CacheHome, "keepr", "blobs")
+		}
+		disk, err := openDiskBlobCache(dir, conf.DiskSize)
+		if err != nil {
+			return nil, fmt.Errorf("open disk cache: %w", err)
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Fits reports whether a blob of the given length can be kept in memory.
+func (c *blobCache) Fits(length int64) bool {
+	return length <= c.maxSize
+}
+
+// Get returns the content of a blob. Blobs that are not cached are read with load, which must verify the content against the BlobID.
+func (c *blobCache) Get(id BlobID, load func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(elem)
+		c.memoryHits++
+		c.mu.Unlock()
+		return elem.Value.(*blobCacheEntry).data, nil
+	}
+	if l, ok := c.loading[id]; ok {
+		c.sharedLoads++
+		c.mu.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+	l := &blobCacheLoad{done: make(chan struct{})}
+	c.loading[id] = l
+	c.mu.Unlock()
+
+	l.data, l.err = c.load(id, load)
+
+	c.mu.Lock()
+	delete(c.loading, id)
+	if l.err == nil {
+		c.add(id, l.data)
+	}
+	c.mu.Unlock()
+	close(l.done)
+	return l.data, l.err
+}
+
+func (c *blobCache) load(id BlobID, load func() ([]byte, error)) ([]byte, error) {
+	if c.disk != nil {
+		if data, ok := c.disk.Get(id); ok {
+			c.mu.Lock()
+			c.diskHits++
+			c.mu.Unlock()
+			return data, nil
+		}
+	}
+
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.destLoads++
+	c.mu.Unlock()
+	if c.disk != nil {
+		if err := c.disk.Put(id, data); err != nil {
+			fmt.Println("WARN: cannot write blob", id.String(), "to disk cache:", err)
+		}
+	}
+	return data, nil
+}
+
+// add inserts a blob and evicts the least recently used blobs until the cache fits its size again. c.mu must be held.
+func (c *blobCache) add(id BlobID, data []byte) {
+	if !c.Fits(int64(len(data))) {
+		return
+	}
+	if _, ok := c.entries[id]; ok {
+		return
+	}
+	c.entries[id] = c.lru.PushFront(&blobCacheEntry{id: id, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*blobCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.id)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// diskBlobCache stores decoded blobs as files named by their BlobID. The least recently used files are removed once maxSize is exceeded.
+type diskBlobCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	files   map[BlobID]*diskBlobCacheFile
+}
+
+type diskBlobCacheFile struct {
+	size    int64
+	lastUse time.Time
+}
+
+func openDiskBlobCache(dir string, maxSize int64) (*diskBlobCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &diskBlobCache{dir: dir, maxSize: maxSize, files: make(map[BlobID]*diskBlobCacheFile)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, err := ParseBlobID(e.Name())
+		if err != nil || !e.Type().IsRegular() {
+			// leftovers of interrupted writes
+			if filepath.Ext(e.Name()) == ".tmp" {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c.files[id] = &diskBlobCacheFile{size: info.Size(), lastUse: info.ModTime()}
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *diskBlobCache) path(id BlobID) string {
+	return filepath.Join(c.dir, id.String())
+}
+
+// Get returns a cached blob. Corrupted files are removed and reported as missing.
+func (c *diskBlobCache) Get(id BlobID) ([]byte, bool) {
+	c.mu.Lock()
+	f, ok := c.files[id]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(c.path(id))
+	if err != nil || sha256.Sum256(data) != id {
+		c.mu.Lock()
+		c.remove(id)
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	f.lastUse = now
+	c.mu.Unlock()
+	// the modification time keeps the order of use for the next process
+	os.Chtimes(c.path(id), now, now)
+	return data, true
+}
+
+func (c *diskBlobCache) Put(id BlobID, data []byte) error {
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+	tmpFile, err := os.CreateTemp(c.dir, id.String()+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), c.path(id)); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.files[id]; ok {
+		c.size -= old.size
+	}
+	c.files[id] = &diskBlobCacheFile{size: int64(len(data)), lastUse: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used files until the cache fits its size. c.mu must be held.
+func (c *diskBlobCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+	ids := make([]BlobID, 0, len(c.files))
+	for id := range c.files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return c.files[ids[i]].lastUse.Before(c.files[ids[j]].lastUse)
+	})
+	for _, id := range ids {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.remove(id)
+	}
+}
+
+// remove deletes a cached file. c.mu must be held.
+func (c *diskBlobCache) remove(id BlobID) {
+	f, ok := c.files[id]
+	if !ok {
+		return
+	}
+	if err := os.Remove(c.path(id)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("WARN: cannot remove blob", id.String(), "from disk cache:", err)
+	}
+	delete(c.files, id)
+	c.size -= f.size
+}
@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testBlob(content string) (BlobID, func() ([]byte, error)) {
+	data := []byte(content)
+	return BlobID(sha256.Sum256(data)), func() ([]byte, error) { return data, nil }
+}
+
+func TestBlobCache(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		c := must(newBlobCache(BackupSetCacheConfig{MemorySize: 10}, false))
+		idA, loadA := testBlob("aaaa")
+		idB, loadB := testBlob("bbbb")
+		idC, loadC := testBlob("cccc")
+
+		require.Equal(t, []byte("aaaa"), must(c.Get(idA, loadA)))
+		require.Equal(t, []byte("bbbb"), must(c.Get(idB, loadB)))
+		require.Equal(t, []byte("aaaa"), must(c.Get(idA, loadA)))
+		require.Equal(t, 2, c.destLoads)
+		require.Equal(t, 1, c.memoryHits)
+
+		// b is the least recently used blob
+		must(c.Get(idC, loadC))
+		require.Equal(t, int64(8), c.size)
+		must(c.Get(idA, loadA))
+		require.Equal(t, 3, c.destLoads)
+		must(c.Get(idB, loadB))
+		require.Equal(t, 4, c.destLoads)
+
+		// blobs larger than the cache are not kept
+		idLarge, loadLarge := testBlob("larger than ten bytes")
+		require.False(t, c.Fits(21))
+		must(c.Get(idLarge, loadLarge))
+		must(c.Get(idLarge, loadLarge))
+		require.Equal(t, 6, c.destLoads)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		c := must(newBlobCache(BackupSetCacheConfig{}, false))
+		id, load := testBlob("shared blob")
+		release := make(chan struct{})
+		var loads int
+		slowLoad := func() ([]byte, error) {
+			loads++
+			<-release
+			return load()
+		}
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := c.Get(id, slowLoad)
+				require.NoError(t, err)
+				require.Equal(t, []byte("shared blob"), data)
+			}()
+		}
+		require.Eventually(t, func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.sharedLoads == 7
+		}, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+		require.Equal(t, 1, loads)
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		dir := t.TempDir()
+		conf := BackupSetCacheConfig{MemorySize: 10, DiskSize: 10, DiskDir: dir}
+		idA, loadA := testBlob("aaaa")
+		idB, loadB := testBlob("bbbb")
+		idC, loadC := testBlob("cccc")
+
+		c := must(newBlobCache(conf, false))
+		must(c.Get(idA, loadA))
+		must(c.Get(idB, loadB))
+		require.FileExists(t, filepath.Join(dir, idA.String()))
+		require.FileExists(t, filepath.Join(dir, idB.String()))
+
+		// a new cache starts with the blobs on disk
+		c = must(newBlobCache(conf, false))
+		require.Equal(t, []byte("aaaa"), must(c.Get(idA, loadA)))
+		require.Equal(t, 1, c.diskHits)
+		require.Equal(t, 0, c.destLoads)
+
+		// b is evicted from disk as least recently used
+		time.Sleep(10 * time.Millisecond)
+		must(c.Get(idC, loadC))
+		require.NoFileExists(t, filepath.Join(dir, idB.String()))
+		require.FileExists(t, filepath.Join(dir, idA.String()))
+
+		// corrupted files are read from the destination again
+		require.NoError(t, os.WriteFile(filepath.Join(dir, idC.String()), []byte("xxxx"), 0600))
+		c = must(newBlobCache(conf, false))
+		require.Equal(t, []byte("cccc"), must(c.Get(idC, loadC)))
+		require.Equal(t, 1, c.destLoads)
+
+		// decoded blobs of encrypted backup sets are only kept in memory
+		c = must(newBlobCache(conf, true))
+		require.Nil(t, c.disk)
+	})
+}
+
+func TestBrowserBlobCache(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+	writeTestFile(t, srcDir, "copy.txt", "first file", time.Now())
+
+	readFiles := func(t *testing.T, browser *Browser) {
+		for _, path := range []string{"a.txt", "copy.txt", "a.txt"} {
+			r := must(browser.OpenFile(path))
+			// small reads like those of the WebDAV server
+			buf := make([]byte, 3)
+			var content []byte
+			for {
+				n, err := r.Read(buf)
+				content = append(content, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+			}
+			require.NoError(t, r.Close())
+			require.Equal(t, "first file", string(content))
+		}
+	}
+
+	t.Run("Raw", func(t *testing.T) {
+		backupSet := newTestBackupSet(t, srcDir)
+		snapshot := takeTestSnapshot(t, backupSet)
+		browser := must(NewBrowser(backupSet, snapshot))
+		defer browser.Close()
+
+		readFiles(t, browser)
+		// only the root tree, file blobs stored as is are read in ranges
+		require.Equal(t, 1, browser.cache.destLoads)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		backupSet := newTestBackupSet(t, srcDir)
+		backupSet.conf.Encryption.Enabled = true
+		backupSet.SetPassword("correct horse")
+		snapshot := takeTestSnapshot(t, backupSet)
+		browser := must(NewBrowser(backupSet, snapshot))
+		defer browser.Close()
+
+		readFiles(t, browser)
+		// the root tree and the blob shared by both files
+		require.Equal(t, 2, browser.cache.destLoads)
+	})
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Stored blob format:
+
+	"KPRB" | codec (1 byte) | uncompressed length (uint32) | payload
+
+The payload is the content encoded with the codec and sealed with the repository key (additional data is BlobID + header) for encrypted repositories.
+Blobs written by older versions have no header and consist of the raw content or the sealed raw content.
+*/
+
+var blobMagic = []byte("KPRB")
+
+const blobHeaderLen = 4 + 1 + 4
+
+type blobCodec byte
+
+const (
+	blobCodecNone blobCodec = 0
+	blobCodecZstd blobCodec = 1
+)
+
+type BackupSetCompressionConfig struct {
+	// Codec is either "zstd" (default) or "none".
+	Codec string
+	// Level is the zstd compression level from 1 (fastest) to 22 (best). 0 selects the default level.
+	Level int
+}
+
+// zstdDecoder is safe for concurrent use with DecodeAll.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+
+type blobEncoder struct {
+	key   *repositoryKey
+	codec blobCodec
+	zstd  *zstd.Encoder
+}
+
+func newBlobEncoder(key *repositoryKey, conf BackupSetCompressionConfig) (*blobEncoder, error) {
+	enc := &blobEncoder{key: key}
+	switch conf.Codec {
+	case "", "zstd":
+		level := zstd.SpeedDefault
+		if conf.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(conf.Level)
+		}
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, fmt.Errorf("init zstd encoder: %w", err)
+		}
+		enc.codec = blobCodecZstd
+		enc.zstd = encoder
+	case "none":
+		enc.codec = blobCodecNone
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", conf.Codec)
+	}
+	return enc, nil
+}
+
+// encode converts blob content into the representation stored in the destination. Content that does not shrink by compression is stored uncompressed.
+func (enc *blobEncoder) encode(id BlobID, content []byte) ([]byte, error) {
+	codec := blobCodecNone
+	payload := content
+	if enc.codec == blobCodecZstd {
+		compressed := enc.zstd.EncodeAll(content, make([]byte, 0, len(content)))
+		if len(compressed) < len(content)-len(content)/32 {
+			codec = blobCodecZstd
+			payload = compressed
+		}
+	}
+
+	header := make([]byte, blobHeaderLen)
+	copy(header, blobMagic)
+	header[4] = byte(codec)
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(content)))
+
+	if enc.key != nil {
+		sealed, err := enc.key.seal(blobAdditionalData(id, header), payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = sealed
+	}
+	return append(header, payload...), nil
+}
+
+// decodeBlob reverses blobEncoder.encode and also accepts blobs without header.
+func decodeBlob(key *repositoryKey, id BlobID, data []byte) ([]byte, error) {
+	if len(data) >= blobHeaderLen && bytes.Equal(data[:4], blobMagic) {
+		content, err := decodeBlobWithHeader(key, id, data)
+		if err == nil {
+			return content, nil
+		}
+		// raw content of old blobs might start with the magic by chance, which is only accepted if it matches the BlobID
+		if key == nil && sha256.Sum256(data) == id {
+			return data, nil
+		}
+		return nil, err
+	}
+
+	// only unencrypted blobs were written without header
+	if key != nil {
+		return nil, fmt.Errorf("encrypted blob %s has no header", id)
+	}
+	return data, nil
+}
+
+func decodeBlobWithHeader(key *repositoryKey, id BlobID, data []byte) ([]byte, error) {
+	header, payload := data[:blobHeaderLen], data[blobHeaderLen:]
+	codec := blobCodec(header[4])
+	rawLen := binary.LittleEndian.Uint32(header[5:])
+
+	if key != nil {
+		plaintext, err := key.open(blobAdditionalData(id, header), payload)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt blob %s: %w", id, err)
+		}
+		payload = plaintext
+	}
+
+	var content []byte
+	switch codec {
+	case blobCodecNone:
+		content = payload
+	case blobCodecZstd:
+		decompressed, err := zstdDecoder.DecodeAll(payload, make([]byte, 0, rawLen))
+		if err != nil {
+			return nil, fmt.Errorf("decompress blob %s: %w", id, err)
+		}
+		content = decompressed
+	default:
+		return nil, fmt.Errorf("blob %s has unknown codec %d", id, codec)
+	}
+
+	if len(content) != int(rawLen) {
+		return nil, fmt.Errorf("blob %s has length %d, but header expects %d", id, len(content), rawLen)
+	}
+	return content, nil
+}
+
+// rawContentOffset returns the offset of the content within an unencrypted stored blob starting with prefix, if the content is stored as is and can be read in ranges.
+func rawContentOffset(prefix []byte, blobLen blobLen) (int64, bool) {
+	if len(prefix) < blobHeaderLen || !bytes.Equal(prefix[:4], blobMagic) {
+		// blob without header
+		return 0, true
+	}
+	if blobCodec(prefix[4]) == blobCodecNone && binary.LittleEndian.Uint32(prefix[5:]) == uint32(blobLen) {
+		return blobHeaderLen, true
+	}
+	// compressed, or raw content of an old blob that starts with the magic
+	return 0, false
+}
+
+func blobAdditionalData(id BlobID, header []byte) []byte {
+	return append(id[:], header...)
+}
+
+// isPlausibleBlobSize reports whether a stored blob of the given size can contain content of length blobLen.
+func isPlausibleBlobSize(size int64, blobLen blobLen, encrypted bool) bool {
+	var overhead int64
+	if encrypted {
+		overhead = encryptionOverhead
+	} else if size == int64(blobLen) {
+		// blob without header
+		return true
+	}
+	return size >= blobHeaderLen+overhead && size <= blobHeaderLen+overhead+int64(blobLen)
+}
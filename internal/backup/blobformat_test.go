@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobFormat(t *testing.T) {
+	key := must(newRepositoryKey(bytes.Repeat([]byte{7}, 32)))
+
+	compressible := bytes.Repeat([]byte("log line with some repeated content\n"), 1000)
+	incompressible := make([]byte, 64*1024)
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name          string
+		key           *repositoryKey
+		conf          BackupSetCompressionConfig
+		content       []byte
+		expectedCodec blobCodec
+	}{
+		{"Zstd", nil, BackupSetCompressionConfig{}, compressible, blobCodecZstd},
+		{"ZstdLevel", nil, BackupSetCompressionConfig{Codec: "zstd", Level: 19}, compressible, blobCodecZstd},
+		{"ZstdEncrypted", key, BackupSetCompressionConfig{}, compressible, blobCodecZstd},
+		{"Incompressible", nil, BackupSetCompressionConfig{}, incompressible, blobCodecNone},
+		{"IncompressibleEncrypted", key, BackupSetCompressionConfig{}, incompressible, blobCodecNone},
+		{"None", nil, BackupSetCompressionConfig{Codec: "none"}, compressible, blobCodecNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id := BlobID(sha256.Sum256(tc.content))
+			enc := must(newBlobEncoder(tc.key, tc.conf))
+			data := must(enc.encode(id, tc.content))
+			require.Equal(t, blobMagic, data[:4])
+			require.Equal(t, byte(tc.expectedCodec), data[4])
+			require.True(t, isPlausibleBlobSize(int64(len(data)), blobLen(len(tc.content)), tc.key != nil))
+			if tc.expectedCodec == blobCodecZstd {
+				require.Less(t, len(data), len(tc.content)/10)
+			}
+			require.Equal(t, tc.content, must(decodeBlob(tc.key, id, data)))
+
+			if tc.key != nil {
+				_, err := decodeBlob(tc.key, BlobID{}, data)
+				require.Error(t, err)
+			}
+		})
+	}
+
+	t.Run("WithoutHeader", func(t *testing.T) {
+		id := BlobID(sha256.Sum256(compressible))
+		require.Equal(t, compressible, must(decodeBlob(nil, id, compressible)))
+		_, err := decodeBlob(key, id, must(key.seal(id[:], compressible)))
+		require.ErrorContains(t, err, "has no header")
+	})
+
+	t.Run("WithoutHeaderStartingWithMagic", func(t *testing.T) {
+		content := append([]byte("KPRB\x00\x01\x00\x00\x00"), compressible...)
+		id := BlobID(sha256.Sum256(content))
+		require.Equal(t, content, must(decodeBlob(nil, id, content)))
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		id := BlobID(sha256.Sum256(compressible))
+		data := must(must(newBlobEncoder(nil, BackupSetCompressionConfig{})).encode(id, compressible))
+		data[len(data)-1] ^= 0xff
+		_, err := decodeBlob(nil, id, data)
+		require.Error(t, err)
+	})
+
+	_, err = newBlobEncoder(nil, BackupSetCompressionConfig{Codec: "lz4"})
+	require.Error(t, err)
+}
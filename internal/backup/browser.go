@@ -1,8 +1,10 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -10,11 +12,14 @@ import (
 )
 
 type Browser struct {
-	backupSet   *BackupSet
-	snapshot    *Snapshot
-	dest        destination.Interface
-	blobIndex   map[BlobID]blobLen
-	prefixIndex map[string]prefix
+	backupSet *BackupSet
+	snapshot  *Snapshot
+	dest      destination.Interface
+	key       *repositoryKey
+	blobIndex map[BlobID]blobLen
+	// cache is shared by all readers of the browser and also holds the trees of the directories that were accessed.
+	cache *blobCache
+	lock  *repositoryLock
 }
 
 func NewBrowser(backupSet *BackupSet, snapshot *Snapshot) (*Browser, error) {
@@ -23,55 +28,67 @@ func NewBrowser(backupSet *BackupSet, snapshot *Snapshot) (*Browser, error) {
 		return nil, fmt.Errorf("init destination: %w", err)
 	}
 
-	blobIndex, err := backupSet.ReadBlobIndex(dest)
+	lock, err := lockRepository(dest, LockShared, "read")
 	if err != nil {
+		dest.Close()
+		return nil, fmt.Errorf("lock repository: %w", err)
+	}
+
+	key, err := backupSet.openRepositoryKey(dest, false)
+	if err != nil {
+		lock.Unlock()
+		dest.Close()
+		return nil, fmt.Errorf("open repository key: %w", err)
+	}
+
+	blobIndex, err := backupSet.readMergedBlobIndex(dest)
+	if err != nil {
+		lock.Unlock()
+		dest.Close()
 		return nil, fmt.Errorf("read blob index: %w", err)
 	}
 
+	cache, err := newBlobCache(backupSet.conf.Cache, key != nil)
+	if err != nil {
+		lock.Unlock()
+		dest.Close()
+		return nil, fmt.Errorf("init blob cache: %w", err)
+	}
+
 	return &Browser{
-		backupSet:   backupSet,
-		snapshot:    snapshot,
-		dest:        dest,
-		blobIndex:   blobIndex,
-		prefixIndex: buildPrefixIndex(backupSet),
+		backupSet: backupSet,
+		snapshot:  snapshot,
+		dest:      dest,
+		key:       key,
+		blobIndex: blobIndex,
+		cache:     cache,
+		lock:      lock,
 	}, nil
 }
 
-type prefix struct {
-	prefix              string
-	directChilds        []string
-	directChildPrefixes []string
-}
-
-func buildPrefixIndex(backupSet *BackupSet) map[string]prefix {
-	//TODO build tree
-	return nil
+// Close releases the repository lock and the destination of the browser. Opened files must not be used afterwards.
+func (browser *Browser) Close() error {
+	return errors.Join(browser.lock.Unlock(), browser.dest.Close())
 }
 
 func (browser *Browser) IsDir(path string) (bool, error) {
-	//TODO use tree
-
-	if len(path) == 0 {
+	if len(strings.Trim(path, "/")) == 0 {
 		return true, nil
 	}
-
-	path = strings.Trim(path, "/") + "/"
-	for _, f := range browser.snapshot.Files {
-		if strings.HasPrefix(f.Path, path) {
-			return true, nil
-		}
+	f, ok, err := browser.lookup(path)
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	return ok && f.IsDir(), nil
 }
 
+// GetFile returns the regular file at path. Directories and symlinks are not reported.
 func (browser *Browser) GetFile(path string) (FileSnapshot, bool, error) {
-	path = strings.Trim(path, "/")
-	for _, f := range browser.snapshot.Files {
-		if f.Path == path {
-			return f, true, nil
-		}
+	f, ok, err := browser.lookup(path)
+	if err != nil || !ok || !f.IsRegular() {
+		return FileSnapshot{}, false, err
 	}
-	return FileSnapshot{}, false, nil
+	return f, true, nil
 }
 
 func (browser *Browser) FileName(path string) string {
@@ -83,40 +100,144 @@ func (browser *Browser) FileName(path string) string {
 }
 
 func (browser *Browser) ListDirs(path string) ([]string, error) {
-	subDirs := make(map[string]struct{}, 0)
-	path = strings.Trim(path, "/")
-	if len(path) > 0 {
-		path += "/"
-	}
-	for _, f := range browser.snapshot.Files {
-		if strings.HasPrefix(f.Path, path) {
-			parts := strings.Split(f.Path[len(path):], "/")
-			if len(parts) > 1 {
-				subDirs[parts[0]] = struct{}{}
-			}
-		}
+	entries, err := browser.readDir(path)
+	if err != nil {
+		return nil, err
 	}
-	dirs := make([]string, 0, len(subDirs))
-	for dir := range subDirs {
-		dirs = append(dirs, dir)
+	dirs := make([]string, 0)
+	for _, f := range entries {
+		if f.IsDir() {
+			dirs = append(dirs, browser.FileName(f.Path))
+		}
 	}
 	return dirs, nil
 }
 
+// ListFiles returns the regular files directly below path.
 func (browser *Browser) ListFiles(path string) ([]FileSnapshot, error) {
-	path = strings.Trim(path, "/")
+	entries, err := browser.readDir(path)
+	if err != nil {
+		return nil, err
+	}
 	files := make([]FileSnapshot, 0)
-	for _, f := range browser.snapshot.Files {
-		parts := strings.Split(f.Path, "/")
-		dir := strings.Join(parts[:len(parts)-1], "/")
-		if path == dir {
+	for _, f := range entries {
+		if f.IsRegular() {
 			files = append(files, f)
 		}
 	}
 	return files, nil
 }
 
+// lookup returns the entry at path. Directories of version 0 indexes are only known by the files they contain and are returned with mode 0755.
+func (browser *Browser) lookup(path string) (FileSnapshot, bool, error) {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return FileSnapshot{}, false, nil
+	}
+
+	if browser.snapshot.Tree == nil {
+		if f, ok := browser.snapshot.Files[path]; ok {
+			return f, true, nil
+		}
+		for _, f := range browser.snapshot.Files {
+			if strings.HasPrefix(f.Path, path+"/") {
+				return FileSnapshot{Path: path, Mode: fs.ModeDir | 0755}, true, nil
+			}
+		}
+		return FileSnapshot{}, false, nil
+	}
+
+	entries, ok, err := browser.readTreeOf(parentPath(path))
+	if err != nil || !ok {
+		return FileSnapshot{}, false, err
+	}
+	f, ok := findTreeEntry(entries, browser.FileName(path))
+	f.Path = path
+	return f, ok, nil
+}
+
+// readDir returns the entries directly below the directory at path. It is empty if there is no such directory.
+func (browser *Browser) readDir(path string) ([]FileSnapshot, error) {
+	path = strings.Trim(path, "/")
+
+	if browser.snapshot.Tree == nil {
+		prefix := path
+		if len(prefix) > 0 {
+			prefix += "/"
+		}
+		children := make(map[string]FileSnapshot)
+		for _, f := range browser.snapshot.Files {
+			if !strings.HasPrefix(f.Path, prefix) {
+				continue
+			}
+			name, _, nested := strings.Cut(f.Path[len(prefix):], "/")
+			if !nested {
+				children[name] = f
+			} else if _, ok := children[name]; !ok {
+				children[name] = FileSnapshot{Path: prefix + name, Mode: fs.ModeDir | 0755}
+			}
+		}
+		entries := make([]FileSnapshot, 0, len(children))
+		for _, name := range sortedPaths(children) {
+			entries = append(entries, children[name])
+		}
+		return entries, nil
+	}
+
+	entries, _, err := browser.readTreeOf(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileSnapshot, 0, len(entries))
+	for _, f := range entries {
+		f.Path = joinPath(path, f.Path)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// readTreeOf returns the decoded tree of the directory at path by reading all trees from the root down to it.
+func (browser *Browser) readTreeOf(path string) ([]FileSnapshot, bool, error) {
+	entries, err := browser.readTree(*browser.snapshot.Tree)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(path) == 0 {
+		return entries, true, nil
+	}
+	for _, name := range strings.Split(path, "/") {
+		dir, ok := findTreeEntry(entries, name)
+		if !ok || dir.Tree == nil {
+			return nil, false, nil
+		}
+		if entries, err = browser.readTree(*dir.Tree); err != nil {
+			return nil, false, err
+		}
+	}
+	return entries, true, nil
+}
+
+// readTree returns a decoded tree. Trees are read through the blob cache, so the memory of large snapshots stays bounded.
+func (browser *Browser) readTree(id BlobID) ([]FileSnapshot, error) {
+	data, err := browser.cache.Get(id, func() ([]byte, error) {
+		return browser.readVerifiedBlob(id)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read tree %s: %w", id, err)
+	}
+	entries, err := decodeTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode tree %s: %w", id, err)
+	}
+	return entries, nil
+}
+
 func (browser *Browser) OpenFile(path string) (io.ReadSeekCloser, error) {
+	return browser.openFile(path, false)
+}
+
+// openFile returns a reader for the file at path. If verify is set, every blob is checked against its BlobID before it is returned.
+func (browser *Browser) openFile(path string, verify bool) (io.ReadSeekCloser, error) {
 	file, exists, err := browser.GetFile(path)
 	if err != nil {
 		return nil, err
@@ -124,46 +245,157 @@ func (browser *Browser) OpenFile(path string) (io.ReadSeekCloser, error) {
 	if !exists {
 		return nil, os.ErrNotExist
 	}
-	return &backupFileReader{browser: browser, file: file}, nil
+	return &backupFileReader{browser: browser, file: file, verify: verify}, nil
 }
 
 type backupFileReader struct {
 	browser    *Browser
 	file       FileSnapshot
 	currentPos int64
+	verify     bool
+
+	// current blob: either the decoded content, or the offset of its raw content in the stored blob
+	blobLoaded    bool
+	blobID        BlobID
+	blobData      []byte
+	blobRawOffset int64
 }
 
 func (r *backupFileReader) Read(p []byte) (int, error) {
-	blobID, blobOffset, ok := r.findBlobIDAndOffset(r.currentPos)
+	blobID, blobOffset, blobLen, ok := r.findBlobIDAndOffset(r.currentPos)
 	if !ok {
 		return 0, io.EOF
 	}
 
-	blobPath := r.browser.snapshot.GetBlobPath(blobID)
-	data, err := r.browser.dest.ReadFile(blobPath)
-	if err != nil {
-		return 0, err
+	if !r.blobLoaded || r.blobID != blobID {
+		if err := r.loadBlob(blobID, blobLen); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	if r.blobData != nil {
+		if blobOffset >= int64(len(r.blobData)) {
+			return 0, fmt.Errorf("blob %s is shorter than expected", blobID)
+		}
+		n = copy(p, r.blobData[blobOffset:])
+	} else {
+		length := min(int64(len(p)), int64(blobLen)-blobOffset)
+		if err := r.browser.readBlobRange(blobID, r.blobRawOffset+blobOffset, p[:length]); err != nil {
+			return 0, err
+		}
+		n = int(length)
 	}
-	n := min(len(p), len(data)-int(blobOffset))
-	copy(p[:n], data[blobOffset:int(blobOffset)+n])
 	r.currentPos += int64(n)
 	return n, nil
 }
 
-func (r *backupFileReader) findBlobIDAndOffset(pos int64) (BlobID, int64, bool) {
+// loadBlob prepares reading from a blob. Blobs that are stored as is are read in ranges, so only the requested data is transferred. All other blobs are decoded completely, through the cache of the browser if they fit, and kept until the next blob is needed. Verifying readers always decode the stored blobs to check them.
+func (r *backupFileReader) loadBlob(id BlobID, length blobLen) error {
+	r.blobLoaded = false
+	r.blobData = nil
+
+	if !r.verify && r.browser.key == nil {
+		prefix := make([]byte, blobHeaderLen)
+		n, err := r.browser.readBlobPrefix(id, prefix)
+		if err != nil {
+			return err
+		}
+		if offset, ok := rawContentOffset(prefix[:n], r.browser.blobIndex[id]); ok {
+			r.blobID, r.blobRawOffset, r.blobLoaded = id, offset, true
+			return nil
+		}
+	}
+
+	if !r.verify && r.browser.cache.Fits(int64(length)) {
+		data, err := r.browser.cache.Get(id, func() ([]byte, error) {
+			return r.browser.readVerifiedBlob(id)
+		})
+		if err != nil {
+			return err
+		}
+		r.blobID, r.blobData, r.blobLoaded = id, data, true
+		return nil
+	}
+
+	data, err := r.browser.readBlob(id)
+	if err != nil {
+		return err
+	}
+	if r.verify {
+		if r.browser.key.blobID(data) != id {
+			return fmt.Errorf("blob %s is corrupted", id)
+		}
+	}
+	r.blobID, r.blobData, r.blobLoaded = id, data, true
+	return nil
+}
+
+// readBlob returns the decoded content of a blob.
+func (browser *Browser) readBlob(id BlobID) ([]byte, error) {
+	data, err := browser.dest.ReadFile(getBlobPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlob(browser.key, id, data)
+}
+
+// readVerifiedBlob returns the decoded content of a blob and fails if it does not match the BlobID.
+func (browser *Browser) readVerifiedBlob(id BlobID) ([]byte, error) {
+	data, err := browser.readBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	if browser.key.blobID(data) != id {
+		return nil, fmt.Errorf("blob %s is corrupted", id)
+	}
+	return data, nil
+}
+
+// readBlobPrefix reads the first bytes of a stored blob into p and returns how many were available.
+func (browser *Browser) readBlobPrefix(id BlobID, p []byte) (int, error) {
+	r, err := browser.dest.OpenReader(getBlobPath(id), 0, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// readBlobRange fills p with stored blob data starting at offset.
+func (browser *Browser) readBlobRange(id BlobID, offset int64, p []byte) error {
+	r, err := browser.dest.OpenReader(getBlobPath(id), offset, int64(len(p)))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return fmt.Errorf("blob %s is shorter than expected", id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *backupFileReader) findBlobIDAndOffset(pos int64) (BlobID, int64, blobLen, bool) {
 	var blobsPos int64
 	for _, blobID := range r.file.Blobs {
 		blobLen, ok := r.browser.blobIndex[blobID]
 		if !ok {
 			fmt.Println("WARN: blob", blobID.String(), "is missing in index")
-			return BlobID{}, 0, false
+			return BlobID{}, 0, 0, false
 		}
 		if pos >= blobsPos && pos < (blobsPos+int64(blobLen)) {
-			return blobID, pos - blobsPos, true
+			return blobID, pos - blobsPos, blobLen, true
 		}
 		blobsPos += int64(blobLen)
 	}
-	return BlobID{}, 0, false
+	return BlobID{}, 0, 0, false
 }
 
 func (r *backupFileReader) Seek(offset int64, whence int) (int64, error) {
@@ -0,0 +1,277 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+type CheckOptions struct {
+	// ReadDataFraction is the fraction of referenced blobs that are read and verified against their BlobID. 0 only checks existence and stored size of blobs, 1 reads all data.
+	ReadDataFraction float64
+}
+
+type CheckReport struct {
+	// Destination describes the checked destination.
+	Destination     string
+	Snapshots       int
+	ReferencedBlobs int
+	IndexedBlobs    int
+	StoredBlobs     int
+	ReadBlobs       int
+	Errors          []CheckError
+	// Warnings describe leftovers of interrupted operations that are removed by prune.
+	Warnings []CheckError
+}
+
+type CheckError struct {
+	// Path is the file in the destination the error refers to.
+	Path    string
+	Message string
+}
+
+func (report *CheckReport) addError(path, format string, args ...any) {
+	report.Errors = append(report.Errors, CheckError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (report *CheckReport) addWarning(path, format string, args ...any) {
+	report.Warnings = append(report.Warnings, CheckError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check verifies the integrity of all snapshot indexes, the blob index and the referenced blobs of every destination. Inconsistencies are collected in one report per destination, an error is only returned if a destination cannot be accessed.
+func (backupSet *BackupSet) Check(opts CheckOptions) ([]*CheckReport, error) {
+	if opts.ReadDataFraction < 0 || opts.ReadDataFraction > 1 {
+		return nil, fmt.Errorf("read data fraction must be between 0 and 1")
+	}
+	if len(backupSet.conf.Destinations) == 0 {
+		return nil, fmt.Errorf("missing destination")
+	}
+
+	dests, openErrs := backupSet.OpenDestinations()
+	defer closeDestinations(dests)
+	reports := make([]*CheckReport, 0, len(dests))
+	var errs []error
+	for i, dest := range dests {
+		name := backupSet.conf.Destinations[i].String()
+		if openErrs[i] != nil {
+			errs = append(errs, fmt.Errorf("init destination %s: %w", name, openErrs[i]))
+			continue
+		}
+		report, err := backupSet.checkDestination(dest, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", name, err))
+			continue
+		}
+		report.Destination = name
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+func (backupSet *BackupSet) checkDestination(dest destination.Interface, opts CheckOptions) (*CheckReport, error) {
+	lock, err := lockRepository(dest, LockShared, "check")
+	if err != nil {
+		return nil, fmt.Errorf("lock repository: %w", err)
+	}
+	defer lock.Unlock()
+
+	encrypted, err := isEncryptedRepository(dest)
+	if err != nil {
+		return nil, fmt.Errorf("check key file: %w", err)
+	}
+	// trees are needed to find the referenced blobs and are encrypted like all other blobs
+	key, err := backupSet.openRepositoryKey(dest, false)
+	if err != nil {
+		return nil, fmt.Errorf("open repository key: %w", err)
+	}
+
+	report := &CheckReport{Errors: make([]CheckError, 0)}
+
+	blobIndex, err := backupSet.ReadBlobIndex(dest)
+	if err != nil {
+		report.addError(".blob-index", "unreadable: %v", err)
+		blobIndex = make(map[BlobID]blobLen)
+	}
+	report.IndexedBlobs = len(blobIndex)
+
+	referencedBlobIDs, err := backupSet.checkSnapshots(dest, key, report)
+	if err != nil {
+		return nil, err
+	}
+	report.ReferencedBlobs = len(referencedBlobIDs)
+
+	storedBlobs := make(map[BlobID]int64)
+	if err := listBlobFiles(dest, ".blobs", nil, storedBlobs); err != nil {
+		return nil, fmt.Errorf("list blobs: %w", err)
+	}
+	report.StoredBlobs = len(storedBlobs)
+
+	for _, blobID := range sortedBlobIDs(referencedBlobIDs) {
+		blobPath := getBlobPath(blobID)
+		blobLen, indexed := blobIndex[blobID]
+		if !indexed {
+			report.addError(blobPath, "blob %s referenced by snapshot %s is missing in blob index", blobID, referencedBlobIDs[blobID])
+		}
+		size, stored := storedBlobs[blobID]
+		if !stored {
+			report.addError(blobPath, "blob %s referenced by snapshot %s does not exist", blobID, referencedBlobIDs[blobID])
+		} else if indexed && !isPlausibleBlobSize(size, blobLen, encrypted) {
+			report.addError(blobPath, "blob %s has stored length %d, which cannot hold %d bytes", blobID, size, blobLen)
+		}
+	}
+
+	for _, blobID := range sortedBlobIDs(blobIndex) {
+		if _, stored := storedBlobs[blobID]; !stored {
+			if _, referenced := referencedBlobIDs[blobID]; !referenced {
+				report.addError(getBlobPath(blobID), "blob %s is listed in blob index, but does not exist", blobID)
+			}
+		}
+	}
+
+	if opts.ReadDataFraction > 0 {
+		blobIDs := make([]BlobID, 0, len(referencedBlobIDs))
+		for _, blobID := range sortedBlobIDs(referencedBlobIDs) {
+			if _, stored := storedBlobs[blobID]; stored {
+				blobIDs = append(blobIDs, blobID)
+			}
+		}
+		rand.Shuffle(len(blobIDs), func(i, j int) {
+			blobIDs[i], blobIDs[j] = blobIDs[j], blobIDs[i]
+		})
+		blobIDs = blobIDs[:int(math.Ceil(opts.ReadDataFraction*float64(len(blobIDs))))]
+
+		for _, blobID := range blobIDs {
+			blobPath := getBlobPath(blobID)
+			data, err := dest.ReadFile(blobPath)
+			if err != nil {
+				report.addError(blobPath, "read blob %s: %v", blobID, err)
+				continue
+			}
+			report.ReadBlobs++
+			content, err := decodeBlob(key, blobID, data)
+			if err != nil {
+				report.addError(blobPath, "%v", err)
+				continue
+			}
+			if key.blobID(content) != blobID {
+				report.addError(blobPath, "blob %s is corrupted", blobID)
+			} else if blobLen, ok := blobIndex[blobID]; ok && len(content) != int(blobLen) {
+				report.addError(blobPath, "blob %s has length %d, but blob index expects %d", blobID, len(content), blobLen)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// checkSnapshots parses all snapshot indexes and their trees and returns the referenced blobs together with the name of the first referencing snapshot.
+func (backupSet *BackupSet) checkSnapshots(dest destination.Interface, key *repositoryKey, report *CheckReport) (map[BlobID]string, error) {
+	files, err := dest.ReadDir("")
+	if err != nil {
+		return nil, fmt.Errorf("read root dir: %w", err)
+	}
+
+	ctx := &snapshotContext{dest: dest}
+	walker := newTreeWalker(dest, key)
+	referencedBlobIDs := make(map[BlobID]string)
+	for _, fi := range files {
+		if !fi.IsDir || !isSnapshotDirName(fi.Name) {
+			continue
+		}
+		indexPath := fi.Name + "/.snapshot"
+		if exists, err := dest.FileExists(indexPath); err != nil || !exists {
+			// the index is written last, so this is left by an interrupted backup
+			report.addWarning(fi.Name, "incomplete snapshot without index")
+			continue
+		}
+		snapshot, err := ReadSnapshotIndex(ctx, indexPath)
+		if err != nil {
+			report.addError(indexPath, "unreadable: %v", err)
+			continue
+		}
+		snapshot.Name = fi.Name
+		if err := snapshot.readTags(dest); err != nil {
+			report.addError(fi.Name+"/"+snapshotTagsFile, "unreadable: %v", err)
+		}
+		report.Snapshots++
+
+		addReferencedBlob := func(blobID BlobID) {
+			if _, ok := referencedBlobIDs[blobID]; !ok {
+				referencedBlobIDs[blobID] = fi.Name
+			}
+		}
+		var totalSize uint64
+		for _, f := range snapshot.Files {
+			totalSize += f.Size
+			for _, blobID := range f.ReferencedBlobs() {
+				addReferencedBlob(blobID)
+			}
+		}
+		if snapshot.Tree != nil {
+			// trees are referenced before they are read, so missing trees are reported like missing blobs
+			addReferencedBlob(*snapshot.Tree)
+			totalSize, err = walker.walk(*snapshot.Tree, func(id BlobID, entries []FileSnapshot) {
+				for _, f := range entries {
+					if f.Tree != nil {
+						addReferencedBlob(*f.Tree)
+					}
+					for _, blobID := range f.ReferencedBlobs() {
+						addReferencedBlob(blobID)
+					}
+				}
+			})
+			if err != nil {
+				report.addError(indexPath, "unreadable tree: %v", err)
+				continue
+			}
+		}
+		if totalSize != snapshot.TotalSize {
+			report.addError(indexPath, "total size %d does not match sum of file sizes %d", snapshot.TotalSize, totalSize)
+		}
+	}
+	return referencedBlobIDs, nil
+}
+
+// listBlobFiles collects all blob files below the fan-out directory relPath with their stored size.
+func listBlobFiles(dest destination.Interface, relPath string, idParts []string, blobs map[BlobID]int64) error {
+	files, err := dest.ReadDir(relPath)
+	if err != nil {
+		if dest.IsNotExists(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir {
+			if len(idParts) < 4 {
+				if err := listBlobFiles(dest, relPath+"/"+fi.Name, append(idParts, fi.Name), blobs); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if len(idParts) != 4 {
+			continue
+		}
+		if blobID, err := ParseBlobID(strings.Join(idParts, "") + fi.Name); err == nil {
+			blobs[blobID] = fi.Size
+		}
+	}
+	return nil
+}
+
+func sortedBlobIDs[V any](blobs map[BlobID]V) []BlobID {
+	ids := make([]BlobID, 0, len(blobs))
+	for id := range blobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return strings.Compare(string(ids[i][:]), string(ids[j][:])) < 0
+	})
+	return ids
+}
@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+	writeTestFile(t, srcDir, "sub/b.txt", "second file", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	dest := must(backupSet.OpenDestination())
+
+	report := must(backupSet.Check(CheckOptions{ReadDataFraction: 1}))[0]
+	require.Empty(t, report.Errors)
+	require.Equal(t, 1, report.Snapshots)
+	// two files and the trees of both directories
+	require.Equal(t, 4, report.ReferencedBlobs)
+	require.Equal(t, 4, report.IndexedBlobs)
+	require.Equal(t, 4, report.StoredBlobs)
+	require.Equal(t, 4, report.ReadBlobs)
+
+	// same length, different content: only detected when reading data
+	blobA := snapshot.Files["a.txt"].Blobs[0]
+	require.NoError(t, dest.WriteFile(getBlobPath(blobA), []byte("FIRST FILE")))
+	report = must(backupSet.Check(CheckOptions{}))[0]
+	require.Empty(t, report.Errors)
+	report = must(backupSet.Check(CheckOptions{ReadDataFraction: 1}))[0]
+	require.Equal(t, []CheckError{{Path: getBlobPath(blobA), Message: "blob " + blobA.String() + " is corrupted"}}, report.Errors)
+
+	blobB := snapshot.Files["sub/b.txt"].Blobs[0]
+	require.NoError(t, dest.WriteFile(getBlobPath(blobB), []byte("trunc")))
+	report = must(backupSet.Check(CheckOptions{}))[0]
+	require.Equal(t, []CheckError{{Path: getBlobPath(blobB), Message: "blob " + blobB.String() + " has stored length 5, which cannot hold 11 bytes"}}, report.Errors)
+
+	require.NoError(t, dest.DeleteFile(getBlobPath(blobB)))
+	report = must(backupSet.Check(CheckOptions{}))[0]
+	require.Equal(t, []CheckError{{Path: getBlobPath(blobB), Message: "blob " + blobB.String() + " referenced by snapshot " + snapshot.Name + " does not exist"}}, report.Errors)
+
+	require.NoError(t, dest.WriteFile(snapshot.Name+"/.snapshot", []byte{42}))
+	report = must(backupSet.Check(CheckOptions{}))[0]
+	require.Equal(t, 0, report.Snapshots)
+	require.Len(t, report.Errors, 2)
+	require.Equal(t, snapshot.Name+"/.snapshot", report.Errors[0].Path)
+	require.Equal(t, getBlobPath(blobB), report.Errors[1].Path)
+}
+
+func TestCheckIncompleteSnapshot(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	dest := must(backupSet.OpenDestination())
+	defer dest.Close()
+
+	// an interrupted backup that wrote the tags, but not the index
+	incomplete := strings.Repeat("ab", 32)
+	require.NoError(t, dest.WriteFile(incomplete+"/"+snapshotTagsFile, []byte{snapshotTagsV0, 0, 0, 0, 0}))
+	require.Len(t, must(backupSet.ListSnapshots()), 1)
+
+	report := must(backupSet.Check(CheckOptions{}))[0]
+	require.Empty(t, report.Errors)
+	require.Equal(t, []CheckError{{Path: incomplete, Message: "incomplete snapshot without index"}}, report.Warnings)
+
+	require.Equal(t, 1, must(backupSet.Prune(true))[0].RemovedIncompleteSnapshots)
+	require.Equal(t, 1, must(backupSet.Prune(false))[0].RemovedIncompleteSnapshots)
+	require.False(t, must(dest.FileExists(incomplete+"/"+snapshotTagsFile)))
+	require.True(t, must(dest.FileExists(snapshot.Name+"/.snapshot")))
+	report = must(backupSet.Check(CheckOptions{}))[0]
+	require.Empty(t, report.Errors)
+	require.Empty(t, report.Warnings)
+}
@@ -0,0 +1,283 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+const (
+	chunkerParamsPath = ".chunker"
+
+	// defaultMinChunkSize, defaultAvgChunkSize and defaultMaxChunkSize are used for new repositories if the backup set does not configure the chunker.
+	defaultMinChunkSize = 512 * 1024
+	defaultAvgChunkSize = 1024 * 1024
+	defaultMaxChunkSize = 8 * 1024 * 1024
+	// maxChunkSize bounds the chunk buffer that is allocated for every file, so a crafted parameter file cannot exhaust the memory.
+	maxChunkSize = 64 * 1024 * 1024
+)
+
+type chunkerAlgorithm byte
+
+const (
+	// chunkerFixed splits files at fixed MaxSize boundaries. It is used by repositories created before content-defined chunking.
+	chunkerFixed chunkerAlgorithm = 0
+	// chunkerFastCDC splits files at content-defined boundaries using FastCDC with normalized chunking.
+	chunkerFastCDC chunkerAlgorithm = 1
+)
+
+type BackupSetChunkerConfig struct {
+	// MinSize, AvgSize and MaxSize configure the chunk sizes in bytes for new repositories. Existing repositories keep their parameters.
+	MinSize uint32
+	AvgSize uint32
+	MaxSize uint32
+}
+
+// chunkerParams are stored in the repository so that every client splits files identically.
+type chunkerParams struct {
+	Algorithm chunkerAlgorithm
+	MinSize   uint32
+	AvgSize   uint32
+	MaxSize   uint32
+	// Seed randomizes the gear table per repository, so chunk boundaries do not reveal which known files are stored. Encrypted repositories additionally key it with the repository key.
+	Seed [32]byte
+}
+
+func (params chunkerParams) validate() error {
+	if params.MaxSize == 0 {
+		return fmt.Errorf("max chunk size must be positive")
+	}
+	if params.MaxSize > maxChunkSize {
+		return fmt.Errorf("max chunk size must not exceed %d bytes", maxChunkSize)
+	}
+	if params.Algorithm == chunkerFastCDC {
+		if params.MinSize < 64 {
+			return fmt.Errorf("min chunk size must be at least 64 bytes")
+		}
+		if params.MinSize >= params.AvgSize || params.AvgSize >= params.MaxSize {
+			return fmt.Errorf("chunk sizes must satisfy min < avg < max")
+		}
+	}
+	return nil
+}
+
+// openChunkerParams returns the chunker parameters of the repository. Parameters for repositories without parameter file are chosen and stored: repositories that already contain blobs keep fixed-size chunking, new repositories use FastCDC.
+func (backupSet *BackupSet) openChunkerParams(dest destination.Interface, existingBlobs map[BlobID]blobLen) (chunkerParams, error) {
+	data, err := dest.ReadFile(chunkerParamsPath)
+	if err == nil {
+		params, err := readChunkerParams(data)
+		if err != nil {
+			return chunkerParams{}, fmt.Errorf("read chunker params: %w", err)
+		}
+		conf := backupSet.conf.Chunker
+		if conf != (BackupSetChunkerConfig{}) && (params.Algorithm != chunkerFastCDC || conf.MinSize != params.MinSize || conf.AvgSize != params.AvgSize || conf.MaxSize != params.MaxSize) {
+			fmt.Println("WARN: configured chunker is ignored, repository already uses", params)
+		}
+		return params, nil
+	}
+	if !dest.IsNotExists(err) {
+		return chunkerParams{}, err
+	}
+
+	var params chunkerParams
+	if len(existingBlobs) > 0 {
+		params = chunkerParams{Algorithm: chunkerFixed, MaxSize: uint32(blobSize)}
+	} else {
+		params = chunkerParams{Algorithm: chunkerFastCDC, MinSize: defaultMinChunkSize, AvgSize: defaultAvgChunkSize, MaxSize: defaultMaxChunkSize}
+		if conf := backupSet.conf.Chunker; conf != (BackupSetChunkerConfig{}) {
+			params.MinSize, params.AvgSize, params.MaxSize = conf.MinSize, conf.AvgSize, conf.MaxSize
+		}
+		if _, err := rand.Read(params.Seed[:]); err != nil {
+			return chunkerParams{}, err
+		}
+	}
+	if err := params.validate(); err != nil {
+		return chunkerParams{}, err
+	}
+
+	data, err = writeChunkerParams(params)
+	if err != nil {
+		return chunkerParams{}, err
+	}
+	if err := dest.WriteFile(chunkerParamsPath, data); err != nil {
+		return chunkerParams{}, fmt.Errorf("write chunker params: %w", err)
+	}
+	return params, nil
+}
+
+func (params chunkerParams) String() string {
+	if params.Algorithm == chunkerFixed {
+		return fmt.Sprintf("fixed chunks of %d bytes", params.MaxSize)
+	}
+	return fmt.Sprintf("FastCDC chunks of %d/%d/%d bytes", params.MinSize, params.AvgSize, params.MaxSize)
+}
+
+func readChunkerParams(data []byte) (chunkerParams, error) {
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return chunkerParams{}, err
+	}
+	if version != 0 {
+		return chunkerParams{}, fmt.Errorf("unsupported chunker params version %d", version)
+	}
+
+	var params chunkerParams
+	if err := binary.Read(r, binary.LittleEndian, &params); err != nil {
+		return chunkerParams{}, err
+	}
+	if params.Algorithm != chunkerFixed && params.Algorithm != chunkerFastCDC {
+		return chunkerParams{}, fmt.Errorf("unsupported chunker algorithm %d", params.Algorithm)
+	}
+	if err := params.validate(); err != nil {
+		return chunkerParams{}, err
+	}
+	return params, nil
+}
+
+func writeChunkerParams(params chunkerParams) ([]byte, error) {
+	w := bytes.NewBuffer(nil)
+
+	// version
+	if err := w.WriteByte(0); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, params); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// chunker splits a stream into blobs. The returned chunk is only valid until the next call of Next.
+type chunker interface {
+	Next() ([]byte, error)
+}
+
+// newChunker returns a chunker for params. gear is only used for FastCDC and must be created by newGearTable.
+func newChunker(r io.Reader, params chunkerParams, gear *gearTable) chunker {
+	if params.Algorithm == chunkerFixed {
+		return &fixedChunker{r: r, buf: make([]byte, params.MaxSize)}
+	}
+
+	avgBits := bits.Len32(params.AvgSize) - 1
+	return &cdcChunker{
+		r:      r,
+		params: params,
+		gear:   gear,
+		buf:    make([]byte, params.MaxSize),
+		maskS:  highBitsMask(avgBits + 1),
+		maskL:  highBitsMask(avgBits - 1),
+	}
+}
+
+type fixedChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return c.buf[:n], nil
+}
+
+type cdcChunker struct {
+	r            io.Reader
+	params       chunkerParams
+	gear         *gearTable
+	buf          []byte
+	start, end   int
+	maskS, maskL uint64
+	readErr      error
+}
+
+func (c *cdcChunker) Next() ([]byte, error) {
+	if c.end-c.start < len(c.buf) && c.readErr == nil {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, err
+			}
+			c.readErr = io.EOF
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the next chunk in data. A stricter mask is used below the average size and a looser one above it to normalize the chunk size distribution.
+func (c *cdcChunker) cut(data []byte) int {
+	minSize := int(c.params.MinSize)
+	avgSize := int(c.params.AvgSize)
+	n := min(len(data), int(c.params.MaxSize))
+	if n <= minSize {
+		return n
+	}
+	avgSize = min(avgSize, n)
+
+	var hash uint64
+	i := minSize
+	for ; i < avgSize; i++ {
+		hash = (hash << 1) + c.gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + c.gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// highBitsMask returns a mask of the n most significant bits, which depend on the last 64 bytes of the rolling gear hash.
+func highBitsMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// gearTable maps bytes to the random values of the rolling gear hash. The table of a repository must never change, otherwise files are split differently and do not deduplicate against existing blobs.
+type gearTable [256]uint64
+
+// newGearTable derives the gear table from the seed of the repository. For encrypted repositories the seed is keyed with the repository key, so the chunk boundaries cannot be computed without the key.
+func newGearTable(seed [32]byte, key *repositoryKey) *gearTable {
+	if key != nil {
+		mac := hmac.New(sha256.New, key.chunkerKey)
+		mac.Write(seed[:])
+		seed = [32]byte(mac.Sum(nil))
+	}
+
+	var table gearTable
+	for i := 0; i < len(table); i += 4 {
+		block := sha256.Sum256(append(seed[:], byte(i/4)))
+		for j := range 4 {
+			table[i+j] = binary.LittleEndian.Uint64(block[8*j:])
+		}
+	}
+	return &table
+}
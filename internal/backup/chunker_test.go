@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCDCChunker(t *testing.T) {
+	params := chunkerParams{Algorithm: chunkerFastCDC, MinSize: 16 * 1024, AvgSize: 64 * 1024, MaxSize: 256 * 1024}
+	require.NoError(t, params.validate())
+
+	data := make([]byte, 8*1024*1024)
+	rng := rand.NewChaCha8([32]byte{1, 2, 3})
+	_, err := rng.Read(data)
+	require.NoError(t, err)
+
+	chunks := chunkAll(t, data, params)
+	require.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		require.LessOrEqual(t, len(chunk), int(params.MaxSize))
+		if i < len(chunks)-1 {
+			require.GreaterOrEqual(t, len(chunk), int(params.MinSize))
+		}
+	}
+	avgSize := len(data) / len(chunks)
+	require.Greater(t, avgSize, int(params.AvgSize)/2)
+	require.Less(t, avgSize, int(params.AvgSize)*2)
+
+	// chunking must be deterministic
+	require.Equal(t, chunkHashes(chunks), chunkHashes(chunkAll(t, data, params)))
+
+	// inserting data at the beginning must only affect the first chunks
+	shifted := append([]byte("inserted"), data...)
+	original := make(map[[32]byte]struct{})
+	for _, hash := range chunkHashes(chunks) {
+		original[hash] = struct{}{}
+	}
+	shiftedHashes := chunkHashes(chunkAll(t, shifted, params))
+	var shared int
+	for _, hash := range shiftedHashes {
+		if _, ok := original[hash]; ok {
+			shared++
+		}
+	}
+	require.GreaterOrEqual(t, shared, len(shiftedHashes)-2)
+
+	// other seeds and keys must result in other boundaries
+	otherSeed := params
+	otherSeed.Seed[0] = 1
+	require.NotEqual(t, chunkHashes(chunks), chunkHashes(chunkAll(t, data, otherSeed)))
+	key := must(newRepositoryKey(make([]byte, 32)))
+	keyed := chunkAllWithGear(t, data, params, newGearTable(params.Seed, key))
+	require.Equal(t, data, bytes.Join(keyed, nil))
+	require.NotEqual(t, chunkHashes(chunks), chunkHashes(keyed))
+}
+
+func TestFixedChunker(t *testing.T) {
+	params := chunkerParams{Algorithm: chunkerFixed, MaxSize: 10}
+	chunks := chunkAll(t, []byte("0123456789abcdefghijXYZ"), params)
+	require.Equal(t, [][]byte{[]byte("0123456789"), []byte("abcdefghij"), []byte("XYZ")}, chunks)
+	require.Empty(t, chunkAll(t, nil, params))
+}
+
+func TestOpenChunkerParams(t *testing.T) {
+	backupSet := newTestBackupSet(t, t.TempDir())
+	dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+
+	params := must(backupSet.openChunkerParams(dest, map[BlobID]blobLen{}))
+	require.Equal(t, chunkerParams{Algorithm: chunkerFastCDC, MinSize: defaultMinChunkSize, AvgSize: defaultAvgChunkSize, MaxSize: defaultMaxChunkSize, Seed: params.Seed}, params)
+	require.NotEqual(t, [32]byte{}, params.Seed)
+
+	// stored params win over the config
+	backupSet.conf.Chunker = BackupSetChunkerConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+	require.Equal(t, params, must(backupSet.openChunkerParams(dest, map[BlobID]blobLen{})))
+
+	newDest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+	newParams := must(backupSet.openChunkerParams(newDest, map[BlobID]blobLen{}))
+	require.Equal(t, chunkerParams{Algorithm: chunkerFastCDC, MinSize: 1024, AvgSize: 4096, MaxSize: 16384, Seed: newParams.Seed}, newParams)
+	require.NotEqual(t, params.Seed, newParams.Seed)
+
+	legacyDest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+	require.Equal(t, chunkerParams{Algorithm: chunkerFixed, MaxSize: uint32(blobSize)}, must(backupSet.openChunkerParams(legacyDest, map[BlobID]blobLen{{1}: 1})))
+
+	backupSet.conf.Chunker = BackupSetChunkerConfig{MinSize: 4096, AvgSize: 1024, MaxSize: 16384}
+	_, err := backupSet.openChunkerParams(must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()})), map[BlobID]blobLen{})
+	require.Error(t, err)
+
+	backupSet.conf.Chunker = BackupSetChunkerConfig{MinSize: 1024, AvgSize: 4096, MaxSize: maxChunkSize + 1}
+	_, err = backupSet.openChunkerParams(must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()})), map[BlobID]blobLen{})
+	require.ErrorContains(t, err, "must not exceed")
+}
+
+func chunkAll(t *testing.T, data []byte, params chunkerParams) [][]byte {
+	return chunkAllWithGear(t, data, params, newGearTable(params.Seed, nil))
+}
+
+func chunkAllWithGear(t *testing.T, data []byte, params chunkerParams, gear *gearTable) [][]byte {
+	c := newChunker(bytes.NewReader(data), params, gear)
+	chunks := make([][]byte, 0)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func chunkHashes(chunks [][]byte) [][32]byte {
+	hashes := make([][32]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+	return hashes
+}
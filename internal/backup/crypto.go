@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	keyFilePath = ".key"
+
+	kdfTime    = uint32(3)
+	kdfMemory  = uint32(64 * 1024)
+	kdfThreads = uint8(4)
+
+	// maxKdfTime and maxKdfMemory (in KiB) bound the parameters accepted from key files, so a crafted key file cannot exhaust the machine.
+	maxKdfTime   = uint32(100)
+	maxKdfMemory = uint32(4 * 1024 * 1024)
+
+	// encryptionOverhead is the number of bytes a sealed blob is longer than its plaintext (nonce and GCM tag).
+	encryptionOverhead = 12 + 16
+)
+
+// repositoryKey seals data with AES-256-GCM. Sealed data consists of a random nonce followed by the ciphertext.
+type repositoryKey struct {
+	aead cipher.AEAD
+	// idKey is derived from the master key and keys the blob IDs.
+	idKey []byte
+	// chunkerKey is derived from the master key and keys the gear table of the chunker.
+	chunkerKey []byte
+}
+
+func newRepositoryKey(masterKey []byte) (*repositoryKey, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &repositoryKey{aead: aead, idKey: deriveKey(masterKey, "keepr blob id"), chunkerKey: deriveKey(masterKey, "keepr chunker")}, nil
+}
+
+func deriveKey(masterKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// blobID returns the ID of blob content. Encrypted repositories use an HMAC instead of the plain SHA-256, so the IDs cannot be used to confirm that some known content is stored.
+func (key *repositoryKey) blobID(content []byte) BlobID {
+	if key == nil {
+		return sha256.Sum256(content)
+	}
+	mac := hmac.New(sha256.New, key.idKey)
+	mac.Write(content)
+	return BlobID(mac.Sum(nil))
+}
+
+func (key *repositoryKey) seal(additionalData, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return key.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (key *repositoryKey) open(additionalData, data []byte) ([]byte, error) {
+	if len(data) < key.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce := data[:key.aead.NonceSize()]
+	return key.aead.Open(nil, nonce, data[key.aead.NonceSize():], additionalData)
+}
+
+// SetPassword sets the password of an encrypted backup set. Without explicit password, it is read from the environment variable KEEPR_PASSWORD or the configured password file.
+func (backupSet *BackupSet) SetPassword(password string) {
+	backupSet.password = password
+}
+
+func (backupSet *BackupSet) getPassword() (string, error) {
+	if len(backupSet.password) > 0 {
+		return backupSet.password, nil
+	}
+	if password, ok := os.LookupEnv("KEEPR_PASSWORD"); ok && len(password) > 0 {
+		return password, nil
+	}
+	if len(backupSet.conf.Encryption.PasswordFile) > 0 {
+		data, err := os.ReadFile(backupSet.conf.Encryption.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", fmt.Errorf("backup set %q is encrypted, but no password is given (set KEEPR_PASSWORD or Encryption.PasswordFile)", backupSet.conf.Name)
+}
+
+func isEncryptedRepository(dest destination.Interface) (bool, error) {
+	return dest.FileExists(keyFilePath)
+}
+
+// openRepositoryKey returns the key of an encrypted repository or nil for unencrypted ones. If init is set, the key file of an empty repository is created according to the encryption config.
+func (backupSet *BackupSet) openRepositoryKey(dest destination.Interface, init bool) (*repositoryKey, error) {
+	encrypted, err := isEncryptedRepository(dest)
+	if err != nil {
+		return nil, fmt.Errorf("check key file: %w", err)
+	}
+
+	if !encrypted {
+		if !init || !backupSet.conf.Encryption.Enabled {
+			return nil, nil
+		}
+		blobIndex, err := backupSet.ReadBlobIndex(dest)
+		if err != nil {
+			return nil, fmt.Errorf("read blob index: %w", err)
+		}
+		if len(blobIndex) > 0 {
+			return nil, fmt.Errorf("encryption is enabled, but destination already contains unencrypted blobs")
+		}
+		return backupSet.initRepositoryKey(dest)
+	}
+
+	if init && !backupSet.conf.Encryption.Enabled {
+		return nil, fmt.Errorf("encryption is disabled, but destination is encrypted")
+	}
+
+	password, err := backupSet.getPassword()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dest.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	return readKeyFile(data, password)
+}
+
+// initRepositoryKey generates a random master key and stores it in the key file, sealed with a key derived from the password.
+func (backupSet *BackupSet) initRepositoryKey(dest destination.Interface) (*repositoryKey, error) {
+	password, err := backupSet.getPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	kek, err := newRepositoryKey(argon2.IDKey([]byte(password), salt, kdfTime, kdfMemory, kdfThreads, 32))
+	if err != nil {
+		return nil, err
+	}
+	sealedMasterKey, err := kek.seal(make([]byte, 32), masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bytes.NewBuffer(nil)
+
+	// version
+	if err := w.WriteByte(0); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, kdfTime); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, kdfMemory); err != nil {
+		return nil, err
+	}
+	if err := w.WriteByte(kdfThreads); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sealedMasterKey); err != nil {
+		return nil, err
+	}
+
+	if err := dest.WriteFile(keyFilePath, w.Bytes()); err != nil {
+		return nil, fmt.Errorf("write key file: %w", err)
+	}
+	return newRepositoryKey(masterKey)
+}
+
+func readKeyFile(data []byte, password string) (*repositoryKey, error) {
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 {
+		return nil, fmt.Errorf("unsupported key file version %d", version)
+	}
+
+	var time, memory uint32
+	if err := binary.Read(r, binary.LittleEndian, &time); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &memory); err != nil {
+		return nil, err
+	}
+	threads, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if time == 0 || time > maxKdfTime || threads == 0 || memory < 8*uint32(threads) || memory > maxKdfMemory {
+		return nil, fmt.Errorf("invalid key derivation parameters (time %d, memory %d KiB, threads %d)", time, memory, threads)
+	}
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+	sealedMasterKey := make([]byte, r.Len())
+	if _, err := io.ReadFull(r, sealedMasterKey); err != nil {
+		return nil, err
+	}
+
+	kek, err := newRepositoryKey(argon2.IDKey([]byte(password), salt, time, memory, threads, 32))
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := kek.open(make([]byte, 32), sealedMasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return newRepositoryKey(masterKey)
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedBackup(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "a.txt", "some secret content", modTime)
+
+	backupSet := newTestBackupSet(t, srcDir)
+	backupSet.conf.Encryption.Enabled = true
+	backupSet.SetPassword("correct horse")
+	snapshot := takeTestSnapshot(t, backupSet)
+
+	dest := must(backupSet.OpenDestination())
+	require.True(t, must(dest.FileExists(keyFilePath)))
+	blobID := snapshot.Files["a.txt"].Blobs[0]
+	data := must(dest.ReadFile(getBlobPath(blobID)))
+	require.Len(t, data, blobHeaderLen+len("some secret content")+encryptionOverhead)
+	require.NotContains(t, string(data), "secret")
+	// blob IDs do not reveal the hash of the content
+	require.NotEqual(t, BlobID(sha256.Sum256([]byte("some secret content"))), blobID)
+	// file names are only stored in the encrypted trees
+	require.NotContains(t, string(must(dest.ReadFile(snapshot.Name+"/.snapshot"))), "a.txt")
+	require.NotContains(t, string(must(dest.ReadFile(getBlobPath(*snapshot.Tree)))), "a.txt")
+
+	targetDir := t.TempDir()
+	require.NoError(t, must(NewBrowser(backupSet, snapshot)).Restore(targetDir, RestoreOptions{}))
+	requireTestFile(t, targetDir, "a.txt", "some secret content", modTime)
+
+	report := must(backupSet.Check(CheckOptions{ReadDataFraction: 1}))[0]
+	require.Empty(t, report.Errors)
+	require.Equal(t, 2, report.ReadBlobs)
+
+	wrongPasswordSet := must(NewBackupSetFromConfig(backupSet.conf))
+	wrongPasswordSet.SetPassword("wrong")
+	_, err := NewBrowser(wrongPasswordSet, snapshot)
+	require.ErrorContains(t, err, "wrong password")
+
+	unencryptedSet := must(NewBackupSetFromConfig(backupSet.conf))
+	unencryptedSet.conf.Encryption.Enabled = false
+	require.ErrorContains(t, must(NewSnapshotter(unencryptedSet, SnapshotOptions{})).TakeSnapshot(), "destination is encrypted")
+}
+
+func TestEncryptionOnUnencryptedRepository(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "plain", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	takeTestSnapshot(t, backupSet)
+
+	backupSet.conf.Encryption.Enabled = true
+	backupSet.SetPassword("correct horse")
+	require.ErrorContains(t, must(NewSnapshotter(backupSet, SnapshotOptions{})).TakeSnapshot(), "already contains unencrypted blobs")
+}
+
+func TestReadKeyFileParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		time    uint32
+		memory  uint32
+		threads uint8
+	}{
+		{"NoTime", 0, kdfMemory, kdfThreads},
+		{"NoThreads", kdfTime, kdfMemory, 0},
+		{"TooLittleMemory", kdfTime, 8, kdfThreads},
+		{"TooMuchMemory", kdfTime, maxKdfMemory + 1, kdfThreads},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			buf.WriteByte(0)
+			binary.Write(&buf, binary.LittleEndian, tc.time)
+			binary.Write(&buf, binary.LittleEndian, tc.memory)
+			buf.WriteByte(tc.threads)
+			buf.Write(make([]byte, 32+60))
+
+			_, err := readKeyFile(buf.Bytes(), "password")
+			require.ErrorContains(t, err, "invalid key derivation parameters")
+		})
+	}
+}
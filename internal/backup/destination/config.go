@@ -1,5 +1,105 @@
 package destination
 
+import "fmt"
+
+// Config selects the destination type. Exactly one of the destination configs must be set.
 type Config struct {
 	LocalFileSystem LocalDirConfig
+	SFTP            *SFTPConfig   `json:",omitempty"`
+	S3              *S3Config     `json:",omitempty"`
+	WebDAV          *WebDAVConfig `json:",omitempty"`
+	// Retry controls retries of failed operations. Remote destinations retry with default settings if it is not set.
+	Retry *RetryConfig `json:",omitempty"`
+	// RateLimit limits the bandwidth used for uploads and downloads.
+	RateLimit *RateLimitConfig `json:",omitempty"`
+}
+
+func (conf Config) String() string {
+	switch {
+	case conf.SFTP != nil:
+		return fmt.Sprintf("sftp://%s@%s%s", conf.SFTP.User, conf.SFTP.Host, conf.SFTP.Path)
+	case conf.S3 != nil:
+		return fmt.Sprintf("s3://%s/%s", conf.S3.Bucket, conf.S3.Prefix)
+	case conf.WebDAV != nil:
+		return conf.WebDAV.URL
+	default:
+		return conf.LocalFileSystem.Path
+	}
+}
+
+// Open initializes the configured destination.
+func (conf Config) Open() (Interface, error) {
+	var count int
+	if len(conf.LocalFileSystem.Path) > 0 {
+		count++
+	}
+	if conf.SFTP != nil {
+		count++
+	}
+	if conf.S3 != nil {
+		count++
+	}
+	if conf.WebDAV != nil {
+		count++
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("multiple destination types configured")
+	}
+
+	var dest Interface
+	var err error
+	retryConf := conf.Retry
+	switch {
+	case len(conf.LocalFileSystem.Path) > 0:
+		dest, err = NewLocalDir(conf.LocalFileSystem)
+		if err != nil {
+			return nil, fmt.Errorf("init local dir destination: %w", err)
+		}
+	case conf.SFTP != nil:
+		dest, err = NewSFTP(*conf.SFTP)
+		if err != nil {
+			return nil, fmt.Errorf("init sftp destination: %w", err)
+		}
+		if retryConf == nil {
+			retryConf = &RetryConfig{}
+		}
+	case conf.S3 != nil:
+		dest, err = NewS3(*conf.S3)
+		if err != nil {
+			return nil, fmt.Errorf("init s3 destination: %w", err)
+		}
+		if retryConf == nil {
+			retryConf = &RetryConfig{}
+		}
+	case conf.WebDAV != nil:
+		dest, err = NewWebDAV(*conf.WebDAV)
+		if err != nil {
+			return nil, fmt.Errorf("init webdav destination: %w", err)
+		}
+		if retryConf == nil {
+			retryConf = &RetryConfig{}
+		}
+	default:
+		return nil, fmt.Errorf("no destination type configured")
+	}
+
+	if conf.RateLimit != nil {
+		// retried transfers are limited as well
+		limited, err := NewRateLimit(dest, *conf.RateLimit)
+		if err != nil {
+			dest.Close()
+			return nil, fmt.Errorf("init rate limit: %w", err)
+		}
+		dest = limited
+	}
+
+	if retryConf == nil {
+		return dest, nil
+	}
+	retry, err := NewRetry(dest, conf.String(), *retryConf)
+	if err != nil {
+		dest.Close()
+		return nil, fmt.Errorf("init retries: %w", err)
+	}
+	return retry, nil
 }
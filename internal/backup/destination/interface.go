@@ -1,18 +1,62 @@
 package destination
 
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
 type Interface interface {
 	ReadDir(relPath string) ([]FileInfo, error)
 	FileExists(relPath string) (bool, error)
 	ReadFile(relPath string) ([]byte, error)
 	WriteFile(relPath string, data []byte) error
-	//TODO open file for writing data and set length
+	// OpenReader returns a reader for length bytes of the file starting at offset. A negative length reads until the end of the file.
+	OpenReader(relPath string, offset, length int64) (io.ReadCloser, error)
+	// OpenWriter creates or truncates the file. Written data is only guaranteed to be stored after Close returned without error. Use Abort to discard the file after an error.
+	OpenWriter(relPath string) (io.WriteCloser, error)
 	DeleteDir(relPath string) error
+	DeleteFile(relPath string) error
 	CreateDir(relPath string) error
 
 	IsNotExists(err error) bool
+
+	// Close releases connections held by the destination. It must not be used afterwards.
+	io.Closer
+}
+
+// Permissions of files and directories created by keepr. Backups may contain confidential data and are only accessible by the owner.
+const (
+	filePerm = 0600
+	dirPerm  = 0700
+)
+
+// tempFileSuffix marks files that are written before being renamed to their final name.
+const tempFileSuffix = ".keepr-tmp"
+
+// IsTempFile reports whether name belongs to an incomplete file that has not been renamed to its final name, e.g. after a crash.
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, tempFileSuffix)
+}
+
+var errAborted = errors.New("write aborted")
+
+// Abort discards a file opened with OpenWriter, so incomplete data does not replace an existing file. Writers that cannot discard written data are just closed.
+func Abort(w io.WriteCloser) error {
+	if a, ok := w.(interface{ Abort() error }); ok {
+		return a.Abort()
+	}
+	return w.Close()
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
 type FileInfo struct {
 	Name  string
 	IsDir bool
+	// Size is the length of a file in bytes and always 0 for directories.
+	Size int64
 }
@@ -1,9 +1,12 @@
 package destination
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 )
 
 type LocalDirConfig struct {
@@ -31,9 +34,18 @@ func (d *LocalDir) ReadDir(relPath string) ([]FileInfo, error) {
 	fis := make([]FileInfo, 0, len(files))
 	for _, fi := range files {
 		if fi.Name() != "." && fi.Name() != ".." {
+			var size int64
+			if !fi.IsDir() {
+				info, err := fi.Info()
+				if err != nil {
+					return nil, err
+				}
+				size = info.Size()
+			}
 			fis = append(fis, FileInfo{
 				Name:  fi.Name(),
 				IsDir: fi.IsDir(),
+				Size:  size,
 			})
 		}
 	}
@@ -59,19 +71,140 @@ func (d *LocalDir) ReadFile(relPath string) ([]byte, error) {
 }
 
 func (d *LocalDir) WriteFile(relPath string, data []byte) error {
+	w, err := d.OpenWriter(relPath)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+func (d *LocalDir) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(d.getLocalPath(relPath))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// OpenWriter writes to a temporary file next to the target. On Close, the file is synced and renamed to its final name, so readers either see the old or the complete new content. Every writer uses its own temporary file, so concurrent writers of the same file cannot mix their data.
+func (d *LocalDir) OpenWriter(relPath string) (io.WriteCloser, error) {
 	file := d.getLocalPath(relPath)
-	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
-		return fmt.Errorf("create parent directory: %w", err)
+	if err := createLocalDir(filepath.Dir(file)); err != nil {
+		return nil, fmt.Errorf("create parent directory: %w", err)
 	}
-	return os.WriteFile(file, data, os.ModePerm)
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(filePerm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &localFileWriter{f: f, path: file}, nil
+}
+
+type localFileWriter struct {
+	f      *os.File
+	path   string
+	failed bool
+}
+
+func (w *localFileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *localFileWriter) Close() error {
+	if w.failed {
+		w.Abort()
+		return fmt.Errorf("discarded %q after failed write", w.path)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return syncLocalDir(filepath.Dir(w.path))
+}
+
+func (w *localFileWriter) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// createLocalDir creates dir and all missing parents. The parent of every created directory is synced, so the new directory survives a crash.
+func createLocalDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := createLocalDir(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, dirPerm); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return syncLocalDir(parent)
+}
+
+// syncLocalDir persists the directory entries of dir. Windows does not support syncing directories.
+func syncLocalDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func (d *LocalDir) DeleteDir(relPath string) error {
 	return os.RemoveAll(d.getLocalPath(relPath))
 }
 
+func (d *LocalDir) DeleteFile(relPath string) error {
+	return os.Remove(d.getLocalPath(relPath))
+}
+
 func (d *LocalDir) CreateDir(relPath string) error {
-	return os.MkdirAll(d.getLocalPath(relPath), os.ModePerm)
+	return createLocalDir(d.getLocalPath(relPath))
+}
+
+func (d *LocalDir) Close() error {
+	return nil
 }
 
 func (d *LocalDir) IsNotExists(err error) bool {
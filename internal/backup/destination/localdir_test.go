@@ -1,6 +1,10 @@
 package destination
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -17,23 +21,105 @@ func TestLocalDir(t *testing.T) {
 	require.NoError(t, ld.WriteFile("test.txt", []byte("a test")))
 	require.True(t, must(ld.FileExists("test.txt")))
 	require.Equal(t, []byte("a test"), must(ld.ReadFile("test.txt")))
-	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false}}, must(ld.ReadDir("/")))
+	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(ld.ReadDir("/")))
 
 	require.False(t, must(ld.FileExists("subdir/stuff.txt")))
 	require.NoError(t, ld.WriteFile("subdir/stuff.txt", []byte("täßt")))
 	require.True(t, must(ld.FileExists("subdir/stuff.txt")))
 	require.Equal(t, []byte("täßt"), must(ld.ReadFile("subdir/stuff.txt")))
-	require.Equal(t, []FileInfo{{Name: "stuff.txt", IsDir: false}}, must(ld.ReadDir("subdir")))
+	require.Equal(t, []FileInfo{{Name: "stuff.txt", IsDir: false, Size: 6}}, must(ld.ReadDir("subdir")))
 	dirContent := must(ld.ReadDir("/"))
 	require.Len(t, dirContent, 2)
-	require.Contains(t, dirContent, FileInfo{Name: "test.txt", IsDir: false})
+	require.Contains(t, dirContent, FileInfo{Name: "test.txt", IsDir: false, Size: 6})
 	require.Contains(t, dirContent, FileInfo{Name: "subdir", IsDir: true})
 
+	require.NoError(t, ld.DeleteFile("subdir/stuff.txt"))
+	require.False(t, must(ld.FileExists("subdir/stuff.txt")))
+	require.Equal(t, []FileInfo{}, must(ld.ReadDir("subdir")))
+	require.True(t, ld.IsNotExists(ld.DeleteFile("subdir/stuff.txt")))
+
 	require.NoError(t, ld.DeleteDir("subdir"))
-	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false}}, must(ld.ReadDir("/")))
+	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(ld.ReadDir("/")))
 
 	require.NoError(t, ld.DeleteDir("test.txt"))
 	require.Equal(t, []FileInfo{}, must(ld.ReadDir("/")))
+
+	testStreams(t, ld)
+	testConcurrentWriters(t, ld)
+}
+
+// testStreams checks OpenWriter and ranged OpenReader of a destination.
+func testStreams(t *testing.T, d Interface) {
+	w := must(d.OpenWriter("stream/data.bin"))
+	must(w.Write([]byte("01234")))
+	must(w.Write([]byte("56789")))
+	require.NoError(t, w.Close())
+	require.Equal(t, []byte("0123456789"), must(d.ReadFile("stream/data.bin")))
+
+	readRange := func(offset, length int64) string {
+		r := must(d.OpenReader("stream/data.bin", offset, length))
+		defer r.Close()
+		return string(must(io.ReadAll(r)))
+	}
+	require.Equal(t, "0123456789", readRange(0, -1))
+	require.Equal(t, "3456", readRange(3, 4))
+	require.Equal(t, "89", readRange(8, -1))
+	require.Equal(t, "89", readRange(8, 10))
+	require.Equal(t, "", readRange(4, 0))
+
+	_, err := d.OpenReader("stream/missing.bin", 0, 4)
+	require.True(t, d.IsNotExists(err))
+
+	require.NoError(t, d.DeleteDir("stream"))
+}
+
+// testConcurrentWriters checks that two writers of the same file do not mix their data.
+func testConcurrentWriters(t *testing.T, d Interface) {
+	first := must(d.OpenWriter("concurrent/data.bin"))
+	second := must(d.OpenWriter("concurrent/data.bin"))
+	must(first.Write([]byte("first-a ")))
+	must(second.Write([]byte("second-a ")))
+	must(first.Write([]byte("first-b")))
+	must(second.Write([]byte("second-b")))
+	tempFiles := must(d.ReadDir("concurrent"))
+	require.Len(t, tempFiles, 2)
+	for _, fi := range tempFiles {
+		require.True(t, IsTempFile(fi.Name), fi.Name)
+	}
+
+	require.NoError(t, first.Close())
+	require.Equal(t, []byte("first-a first-b"), must(d.ReadFile("concurrent/data.bin")))
+	require.NoError(t, second.Close())
+	require.Equal(t, []byte("second-a second-b"), must(d.ReadFile("concurrent/data.bin")))
+	require.Equal(t, []FileInfo{{Name: "data.bin", Size: 17}}, must(d.ReadDir("concurrent")))
+
+	require.NoError(t, d.DeleteDir("concurrent"))
+}
+
+func TestLocalDirAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	ld := must(NewLocalDir(LocalDirConfig{Path: dir}))
+
+	require.NoError(t, ld.WriteFile("sub/.blob-index", []byte("old")))
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(0600), must(os.Stat(filepath.Join(dir, "sub/.blob-index"))).Mode().Perm())
+		require.Equal(t, os.FileMode(0700), must(os.Stat(filepath.Join(dir, "sub"))).Mode().Perm())
+	}
+
+	// the old content stays visible until the new file is complete
+	w := must(ld.OpenWriter("sub/.blob-index"))
+	must(w.Write([]byte("new")))
+	require.Equal(t, []byte("old"), must(ld.ReadFile("sub/.blob-index")))
+	require.NoError(t, Abort(w))
+	require.Equal(t, []byte("old"), must(ld.ReadFile("sub/.blob-index")))
+	require.Equal(t, []FileInfo{{Name: ".blob-index", Size: 3}}, must(ld.ReadDir("sub")))
+
+	// stale temporary files of interrupted writes are left for prune
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub/.blob-index.keepr-tmp"), []byte("incomplete data"), 0600))
+	require.True(t, IsTempFile(".blob-index.keepr-tmp"))
+	require.NoError(t, ld.WriteFile("sub/.blob-index", []byte("new")))
+	require.Equal(t, []byte("new"), must(ld.ReadFile("sub/.blob-index")))
+	require.Equal(t, []FileInfo{{Name: ".blob-index", Size: 3}, {Name: ".blob-index.keepr-tmp", Size: 15}}, must(ld.ReadDir("sub")))
 }
 
 //TODO test some error cases
@@ -0,0 +1,210 @@
+package destination
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Mirror combines multiple destinations holding the same repository. Reads are served by the first destination that succeeds, writes are applied to all destinations.
+type Mirror struct {
+	dests []Interface
+}
+
+func NewMirror(dests []Interface) (*Mirror, error) {
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("mirror needs at least one destination")
+	}
+	return &Mirror{dests: dests}, nil
+}
+
+// Destinations returns the mirrored destinations in order.
+func (m *Mirror) Destinations() []Interface {
+	return m.dests
+}
+
+// ReadDir merges the directory contents of all destinations. Errors are only returned if no destination can be read.
+func (m *Mirror) ReadDir(relPath string) ([]FileInfo, error) {
+	var errs []error
+	seen := make(map[string]struct{})
+	fis := make([]FileInfo, 0)
+	for _, dest := range m.dests {
+		destFis, err := dest.ReadDir(relPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, fi := range destFis {
+			if _, ok := seen[fi.Name]; !ok {
+				seen[fi.Name] = struct{}{}
+				fis = append(fis, fi)
+			}
+		}
+	}
+	if len(errs) == len(m.dests) {
+		return nil, m.firstError(errs)
+	}
+	return fis, nil
+}
+
+func (m *Mirror) FileExists(relPath string) (bool, error) {
+	var errs []error
+	for _, dest := range m.dests {
+		exists, err := dest.FileExists(relPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	if len(errs) == len(m.dests) {
+		return false, m.firstError(errs)
+	}
+	return false, nil
+}
+
+func (m *Mirror) ReadFile(relPath string) ([]byte, error) {
+	var errs []error
+	for _, dest := range m.dests {
+		data, err := dest.ReadFile(relPath)
+		if err == nil {
+			return data, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, m.firstError(errs)
+}
+
+func (m *Mirror) WriteFile(relPath string, data []byte) error {
+	return m.forAll(func(dest Interface) error {
+		return dest.WriteFile(relPath, data)
+	})
+}
+
+func (m *Mirror) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	var errs []error
+	for _, dest := range m.dests {
+		r, err := dest.OpenReader(relPath, offset, length)
+		if err == nil {
+			return r, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, m.firstError(errs)
+}
+
+// OpenWriter returns a writer that writes to all destinations. It fails if any destination cannot be written.
+func (m *Mirror) OpenWriter(relPath string) (io.WriteCloser, error) {
+	writers := make([]io.WriteCloser, 0, len(m.dests))
+	for i, dest := range m.dests {
+		w, err := dest.OpenWriter(relPath)
+		if err != nil {
+			for _, w := range writers {
+				Abort(w)
+			}
+			return nil, fmt.Errorf("destination %d: %w", i+1, err)
+		}
+		writers = append(writers, w)
+	}
+	return &mirrorWriter{writers: writers}, nil
+}
+
+type mirrorWriter struct {
+	writers []io.WriteCloser
+	failed  bool
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	for i, writer := range w.writers {
+		if _, err := writer.Write(p); err != nil {
+			w.failed = true
+			return 0, fmt.Errorf("destination %d: %w", i+1, err)
+		}
+	}
+	return len(p), nil
+}
+
+// Close discards the file on all destinations if any write failed, so no destination keeps incomplete data.
+func (w *mirrorWriter) Close() error {
+	if w.failed {
+		w.Abort()
+		return fmt.Errorf("discarded file after failed write")
+	}
+	var errs []error
+	for i, writer := range w.writers {
+		if err := writer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("destination %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *mirrorWriter) Abort() error {
+	var errs []error
+	for i, writer := range w.writers {
+		if err := Abort(writer); err != nil {
+			errs = append(errs, fmt.Errorf("destination %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mirror) DeleteDir(relPath string) error {
+	return m.forAll(func(dest Interface) error {
+		return dest.DeleteDir(relPath)
+	})
+}
+
+func (m *Mirror) DeleteFile(relPath string) error {
+	return m.forAll(func(dest Interface) error {
+		return dest.DeleteFile(relPath)
+	})
+}
+
+func (m *Mirror) CreateDir(relPath string) error {
+	return m.forAll(func(dest Interface) error {
+		return dest.CreateDir(relPath)
+	})
+}
+
+// Close closes all mirrored destinations.
+func (m *Mirror) Close() error {
+	var errs []error
+	for _, dest := range m.dests {
+		if err := dest.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mirror) IsNotExists(err error) bool {
+	for _, dest := range m.dests {
+		if dest.IsNotExists(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mirror) forAll(f func(dest Interface) error) error {
+	var errs []error
+	for i, dest := range m.dests {
+		if err := f(dest); err != nil {
+			errs = append(errs, fmt.Errorf("destination %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// firstError prefers errors other than not-exists, so that unreachable destinations are not reported as missing files. errs must contain one error per destination.
+func (m *Mirror) firstError(errs []error) error {
+	for i, err := range errs {
+		if !m.dests[i].IsNotExists(err) {
+			return err
+		}
+	}
+	return errs[0]
+}
@@ -0,0 +1,42 @@
+package destination
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	first := must(NewLocalDir(LocalDirConfig{Path: t.TempDir()}))
+	second := must(NewLocalDir(LocalDirConfig{Path: t.TempDir()}))
+	m := must(NewMirror([]Interface{first, second}))
+
+	require.NoError(t, m.WriteFile("test.txt", []byte("a test")))
+	require.Equal(t, []byte("a test"), must(first.ReadFile("test.txt")))
+	require.Equal(t, []byte("a test"), must(second.ReadFile("test.txt")))
+
+	// reads fall back to the next destination
+	require.NoError(t, first.DeleteFile("test.txt"))
+	require.True(t, must(m.FileExists("test.txt")))
+	require.Equal(t, []byte("a test"), must(m.ReadFile("test.txt")))
+
+	// directory listings are merged
+	require.NoError(t, first.WriteFile("only-first.txt", []byte("first")))
+	dirContent := must(m.ReadDir(""))
+	require.Len(t, dirContent, 2)
+	require.Contains(t, dirContent, FileInfo{Name: "test.txt", Size: 6})
+	require.Contains(t, dirContent, FileInfo{Name: "only-first.txt", Size: 5})
+
+	_, err := m.ReadFile("missing.txt")
+	require.True(t, m.IsNotExists(err))
+	require.False(t, must(m.FileExists("missing.txt")))
+
+	testStreams(t, m)
+
+	require.NoError(t, m.DeleteDir(""))
+	require.False(t, must(first.FileExists("only-first.txt")))
+	require.False(t, must(second.FileExists("test.txt")))
+
+	_, err = NewMirror(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,148 @@
+package destination
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sbreitf1/keepr/internal/ratelimit"
+)
+
+// RateLimitConfig limits the bandwidth used by a destination. Rates are given in bytes per second, 0 is unlimited.
+type RateLimitConfig struct {
+	Upload   int64
+	Download int64
+	// Schedule overrides the rates during periods of the day, e.g. to allow unlimited transfers at night. The first matching period is used.
+	Schedule []RateLimitPeriodConfig
+}
+
+type RateLimitPeriodConfig struct {
+	// From and To are given in local time like "22:00". A period that ends before it starts spans midnight.
+	From     string
+	To       string
+	Upload   int64
+	Download int64
+}
+
+// RateLimit limits the data read from and written to a destination. The limits are shared by all concurrent transfers.
+type RateLimit struct {
+	dest     Interface
+	upload   *ratelimit.Limiter
+	download *ratelimit.Limiter
+}
+
+func NewRateLimit(dest Interface, conf RateLimitConfig) (*RateLimit, error) {
+	if conf.Upload < 0 || conf.Download < 0 {
+		return nil, fmt.Errorf("rates must not be negative")
+	}
+	var uploadRates, downloadRates []ratelimit.ScheduledRate
+	for i, periodConf := range conf.Schedule {
+		period, err := ratelimit.ParsePeriod(periodConf.From, periodConf.To)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %w", i+1, err)
+		}
+		if periodConf.Upload < 0 || periodConf.Download < 0 {
+			return nil, fmt.Errorf("schedule %d: rates must not be negative", i+1)
+		}
+		uploadRates = append(uploadRates, ratelimit.ScheduledRate{Period: period, Rate: periodConf.Upload})
+		downloadRates = append(downloadRates, ratelimit.ScheduledRate{Period: period, Rate: periodConf.Download})
+	}
+
+	r := &RateLimit{dest: dest}
+	if rate := ratelimit.Schedule(conf.Upload, uploadRates); rate != nil {
+		r.upload = ratelimit.NewLimiter(rate)
+	}
+	if rate := ratelimit.Schedule(conf.Download, downloadRates); rate != nil {
+		r.download = ratelimit.NewLimiter(rate)
+	}
+	return r, nil
+}
+
+func (r *RateLimit) ReadDir(relPath string) ([]FileInfo, error) {
+	return r.dest.ReadDir(relPath)
+}
+
+func (r *RateLimit) FileExists(relPath string) (bool, error) {
+	return r.dest.FileExists(relPath)
+}
+
+func (r *RateLimit) ReadFile(relPath string) ([]byte, error) {
+	if r.download == nil {
+		return r.dest.ReadFile(relPath)
+	}
+	rc, err := r.OpenReader(relPath, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (r *RateLimit) WriteFile(relPath string, data []byte) error {
+	if r.upload == nil {
+		return r.dest.WriteFile(relPath, data)
+	}
+	w, err := r.OpenWriter(relPath)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+func (r *RateLimit) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := r.dest.OpenReader(relPath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return r.download.ReadCloser(rc), nil
+}
+
+func (r *RateLimit) OpenWriter(relPath string) (io.WriteCloser, error) {
+	w, err := r.dest.OpenWriter(relPath)
+	if err != nil || r.upload == nil {
+		return w, err
+	}
+	return &rateLimitWriter{Writer: r.upload.Writer(w), w: w}, nil
+}
+
+type rateLimitWriter struct {
+	io.Writer
+	w io.WriteCloser
+}
+
+func (w *rateLimitWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *rateLimitWriter) Abort() error {
+	return Abort(w.w)
+}
+
+func (r *RateLimit) DeleteDir(relPath string) error {
+	return r.dest.DeleteDir(relPath)
+}
+
+func (r *RateLimit) DeleteFile(relPath string) error {
+	return r.dest.DeleteFile(relPath)
+}
+
+func (r *RateLimit) CreateDir(relPath string) error {
+	return r.dest.CreateDir(relPath)
+}
+
+func (r *RateLimit) Close() error {
+	return r.dest.Close()
+}
+
+func (r *RateLimit) IsNotExists(err error) bool {
+	return r.dest.IsNotExists(err)
+}
+
+// IsTransient forwards the classification of errors by the underlying destination to Retry.
+func (r *RateLimit) IsTransient(err error) bool {
+	c, ok := r.dest.(interface{ IsTransient(err error) bool })
+	return ok && c.IsTransient(err)
+}
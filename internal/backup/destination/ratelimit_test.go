@@ -0,0 +1,34 @@
+package destination
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	local := must(NewLocalDir(LocalDirConfig{Path: t.TempDir()}))
+	r := must(NewRateLimit(local, RateLimitConfig{
+		Upload:   1 << 30,
+		Download: 1 << 30,
+		Schedule: []RateLimitPeriodConfig{{From: "22:00", To: "06:00"}},
+	}))
+
+	require.NoError(t, r.WriteFile("test.txt", []byte("0123456789")))
+	require.Equal(t, []byte("0123456789"), must(r.ReadFile("test.txt")))
+	rc := must(r.OpenReader("test.txt", 2, 3))
+	require.Equal(t, []byte("234"), must(io.ReadAll(rc)))
+	require.NoError(t, rc.Close())
+
+	// aborted writes keep the previous content
+	w := must(r.OpenWriter("test.txt"))
+	must(w.Write([]byte("replaced")))
+	require.NoError(t, Abort(w))
+	require.Equal(t, []byte("0123456789"), must(r.ReadFile("test.txt")))
+
+	_, err := NewRateLimit(local, RateLimitConfig{Schedule: []RateLimitPeriodConfig{{From: "late", To: "06:00"}}})
+	require.ErrorContains(t, err, "schedule 1: invalid From")
+	_, err = NewRateLimit(local, RateLimitConfig{Upload: -1})
+	require.Error(t, err)
+}
@@ -0,0 +1,365 @@
+package destination
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryConfig controls how failed operations of a destination are retried. Durations are given like "500ms", "30s" or "5m".
+type RetryConfig struct {
+	// MaxAttempts limits the attempts per operation including the first one and defaults to 5. Set it to 1 to disable retries.
+	MaxAttempts int
+	// InitialDelay is the wait time before the first retry and defaults to 1s. It is doubled for every further retry.
+	InitialDelay string
+	// MaxDelay limits the wait time between two attempts and defaults to 30s.
+	MaxDelay string
+	// Deadline limits the total time spent on one operation including all retries and defaults to 5m.
+	Deadline string
+}
+
+// Retry repeats operations of a destination that failed with transient errors, like timeouts or lost connections, with exponential backoff and jitter. Permanent errors are returned right away.
+type Retry struct {
+	dest         Interface
+	name         string
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	deadline     time.Duration
+	replaySize   int
+	now          func() time.Time
+	sleep        func(time.Duration)
+}
+
+func NewRetry(dest Interface, name string, conf RetryConfig) (*Retry, error) {
+	r := &Retry{dest: dest, name: name, maxAttempts: conf.MaxAttempts, replaySize: retryReplaySize, now: time.Now, sleep: time.Sleep}
+	if r.maxAttempts == 0 {
+		r.maxAttempts = 5
+	} else if r.maxAttempts < 0 {
+		return nil, fmt.Errorf("MaxAttempts must not be negative")
+	}
+
+	for _, d := range []struct {
+		name   string
+		str    string
+		def    time.Duration
+		target *time.Duration
+	}{
+		{"InitialDelay", conf.InitialDelay, time.Second, &r.initialDelay},
+		{"MaxDelay", conf.MaxDelay, 30 * time.Second, &r.maxDelay},
+		{"Deadline", conf.Deadline, 5 * time.Minute, &r.deadline},
+	} {
+		*d.target = d.def
+		if len(d.str) > 0 {
+			v, err := time.ParseDuration(d.str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", d.name, err)
+			}
+			if v < 0 {
+				return nil, fmt.Errorf("%s must not be negative", d.name)
+			}
+			*d.target = v
+		}
+	}
+	return r, nil
+}
+
+// isTransient reports whether an operation that failed with err may succeed when repeated.
+func (r *Retry) isTransient(err error) bool {
+	if err == nil || r.dest.IsNotExists(err) || errors.Is(err, errAborted) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrExist) {
+		return false
+	}
+	if c, ok := r.dest.(interface{ IsTransient(err error) bool }); ok && c.IsTransient(err) {
+		return true
+	}
+	// every failed HTTP request is a *url.Error, which is only transient if its cause is
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, transientErr := range []error{io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT} {
+		if errors.Is(err, transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientHTTPStatus reports whether a request that failed with the given status code may succeed when repeated.
+func isTransientHTTPStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// do calls f until it succeeds, fails with a permanent error, or the attempts or deadline are exhausted. Errors of the first attempt are returned unchanged, so they can still be inspected by IsNotExists.
+func (r *Retry) do(op, relPath string, f func() error) error {
+	start := r.now()
+	delay := r.initialDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !r.isTransient(err) {
+			return err
+		}
+		if attempt >= r.maxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+		}
+
+		// equal jitter: wait between half and the full delay
+		wait := delay/2 + rand.N(delay/2+1)
+		if r.now().Add(wait).Sub(start) > r.deadline {
+			return fmt.Errorf("%w (gave up after %d attempts, deadline of %s exceeded)", err, attempt, r.deadline)
+		}
+		fmt.Printf("WARN: destination %s: %s %q failed (attempt %d of %d), retrying in %s: %v\n", r.name, op, relPath, attempt, r.maxAttempts, wait.Round(time.Millisecond), err)
+		r.sleep(wait)
+		delay = min(delay*2, r.maxDelay)
+	}
+}
+
+func (r *Retry) ReadDir(relPath string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := r.do("read dir", relPath, func() error {
+		var err error
+		files, err = r.dest.ReadDir(relPath)
+		return err
+	})
+	return files, err
+}
+
+func (r *Retry) FileExists(relPath string) (bool, error) {
+	var exists bool
+	err := r.do("check file", relPath, func() error {
+		var err error
+		exists, err = r.dest.FileExists(relPath)
+		return err
+	})
+	return exists, err
+}
+
+func (r *Retry) ReadFile(relPath string) ([]byte, error) {
+	var data []byte
+	err := r.do("read file", relPath, func() error {
+		var err error
+		data, err = r.dest.ReadFile(relPath)
+		return err
+	})
+	return data, err
+}
+
+func (r *Retry) WriteFile(relPath string, data []byte) error {
+	return r.do("write file", relPath, func() error {
+		return r.dest.WriteFile(relPath, data)
+	})
+}
+
+// OpenReader resumes reading at the current position if the returned reader fails with a transient error.
+func (r *Retry) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := r.openReader(relPath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &retryReader{retry: r, relPath: relPath, offset: offset, length: length, rc: rc}, nil
+}
+
+func (r *Retry) openReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := r.do("open file", relPath, func() error {
+		var err error
+		rc, err = r.dest.OpenReader(relPath, offset, length)
+		return err
+	})
+	return rc, err
+}
+
+type retryReader struct {
+	retry   *Retry
+	relPath string
+	offset  int64
+	length  int64
+	rc      io.ReadCloser
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	if r.length >= 0 {
+		r.length -= int64(n)
+	}
+	if err == nil || err == io.EOF || !r.retry.isTransient(err) {
+		return n, err
+	}
+
+	r.rc.Close()
+	fmt.Printf("WARN: destination %s: read %q failed at offset %d, reopening: %v\n", r.retry.name, r.relPath, r.offset, err)
+	rc, err := r.retry.openReader(r.relPath, r.offset, r.length)
+	if err != nil {
+		r.rc = io.NopCloser(&failedReader{err: err})
+		return n, err
+	}
+	r.rc = rc
+	return n, nil
+}
+
+func (r *retryReader) Close() error {
+	return r.rc.Close()
+}
+
+type failedReader struct {
+	err error
+}
+
+func (r *failedReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// retryReplaySize limits the data a writer keeps in memory to write it again after a transient error. It fits the largest encoded blobs, larger files are streamed without retries.
+const retryReplaySize = 80 * 1024 * 1024
+
+// OpenWriter keeps the written data in memory up to retryReplaySize, so the file can be written again from the start if the destination fails with a transient error. Errors of larger files are returned directly.
+func (r *Retry) OpenWriter(relPath string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	err := r.do("open file", relPath, func() error {
+		var err error
+		w, err = r.dest.OpenWriter(relPath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retryWriter{retry: r, relPath: relPath, w: w, replayable: true}, nil
+}
+
+type retryWriter struct {
+	retry   *Retry
+	relPath string
+	// w is nil after it has been closed or aborted.
+	w io.WriteCloser
+	// data contains everything written so far to replay it on a new writer, as long as replayable is set.
+	data       bytes.Buffer
+	replayable bool
+	failed     bool
+}
+
+func (w *retryWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return 0, fmt.Errorf("write %q: previous write failed", w.relPath)
+	}
+	if w.replayable && w.data.Len()+len(p) > w.retry.replaySize {
+		w.replayable = false
+		w.data = bytes.Buffer{}
+	}
+	if !w.replayable {
+		n, err := w.w.Write(p)
+		if err != nil {
+			w.failed = true
+		}
+		return n, err
+	}
+	w.data.Write(p)
+	first := true
+	err := w.retry.do("write file", w.relPath, func() error {
+		if !first {
+			// the replayed data already contains p
+			return w.reopen()
+		}
+		first = false
+		_, err := w.w.Write(p)
+		return err
+	})
+	if err != nil {
+		w.failed = true
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *retryWriter) Close() error {
+	if w.failed {
+		w.Abort()
+		return fmt.Errorf("discarded %q after failed write", w.relPath)
+	}
+	if !w.replayable {
+		err := w.w.Close()
+		w.w = nil
+		return err
+	}
+	first := true
+	return w.retry.do("write file", w.relPath, func() error {
+		if !first {
+			if err := w.reopen(); err != nil {
+				return err
+			}
+		}
+		first = false
+		err := w.w.Close()
+		w.w = nil
+		return err
+	})
+}
+
+func (w *retryWriter) Abort() error {
+	if w.w == nil {
+		return nil
+	}
+	err := Abort(w.w)
+	w.w = nil
+	return err
+}
+
+// reopen discards the current writer and writes all data to a new one.
+func (w *retryWriter) reopen() error {
+	w.Abort()
+	nw, err := w.retry.dest.OpenWriter(w.relPath)
+	if err != nil {
+		return err
+	}
+	w.w = nw
+	_, err = nw.Write(w.data.Bytes())
+	return err
+}
+
+func (r *Retry) DeleteDir(relPath string) error {
+	return r.do("delete dir", relPath, func() error {
+		return r.dest.DeleteDir(relPath)
+	})
+}
+
+func (r *Retry) DeleteFile(relPath string) error {
+	retried := false
+	return r.do("delete file", relPath, func() error {
+		err := r.dest.DeleteFile(relPath)
+		if retried && r.dest.IsNotExists(err) {
+			// removed by an earlier attempt that failed afterwards
+			return nil
+		}
+		retried = true
+		return err
+	})
+}
+
+func (r *Retry) CreateDir(relPath string) error {
+	return r.do("create dir", relPath, func() error {
+		return r.dest.CreateDir(relPath)
+	})
+}
+
+func (r *Retry) Close() error {
+	return r.dest.Close()
+}
+
+func (r *Retry) IsNotExists(err error) bool {
+	return r.dest.IsNotExists(err)
+}
@@ -0,0 +1,227 @@
+package destination
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDest fails the next failures operations with a lost connection.
+type flakyDest struct {
+	Interface
+	failures int
+	calls    int
+}
+
+func (d *flakyDest) fail() error {
+	d.calls++
+	if d.failures > 0 {
+		d.failures--
+		return syscall.ECONNRESET
+	}
+	return nil
+}
+
+func (d *flakyDest) ReadFile(relPath string) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.Interface.ReadFile(relPath)
+}
+
+func (d *flakyDest) WriteFile(relPath string, data []byte) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.Interface.WriteFile(relPath, data)
+}
+
+func (d *flakyDest) DeleteFile(relPath string) error {
+	if err := d.Interface.DeleteFile(relPath); err != nil {
+		return err
+	}
+	// the file is removed, but the response is lost
+	return d.fail()
+}
+
+func (d *flakyDest) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := d.Interface.OpenReader(relPath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyReadCloser{ReadCloser: rc, dest: d}, nil
+}
+
+func (d *flakyDest) OpenWriter(relPath string) (io.WriteCloser, error) {
+	w, err := d.Interface.OpenWriter(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyWriteCloser{WriteCloser: w, dest: d}, nil
+}
+
+type flakyReadCloser struct {
+	io.ReadCloser
+	dest *flakyDest
+}
+
+// Read returns a single byte per call to fail in the middle of the stream.
+func (r *flakyReadCloser) Read(p []byte) (int, error) {
+	if err := r.dest.fail(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p[:min(len(p), 1)])
+}
+
+type flakyWriteCloser struct {
+	io.WriteCloser
+	dest *flakyDest
+}
+
+func (w *flakyWriteCloser) Write(p []byte) (int, error) {
+	if err := w.dest.fail(); err != nil {
+		return 0, err
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func (w *flakyWriteCloser) Abort() error {
+	return Abort(w.WriteCloser)
+}
+
+func newTestRetry(t *testing.T, conf RetryConfig) (*Retry, *flakyDest, *[]time.Duration) {
+	flaky := &flakyDest{Interface: must(NewLocalDir(LocalDirConfig{Path: t.TempDir()}))}
+	r := must(NewRetry(flaky, "test", conf))
+	var sleeps []time.Duration
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	return r, flaky, &sleeps
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("Backoff", func(t *testing.T) {
+		r, flaky, sleeps := newTestRetry(t, RetryConfig{InitialDelay: "1s", MaxDelay: "3s"})
+		flaky.failures = 4
+		require.NoError(t, r.WriteFile("test.txt", []byte("a test")))
+		require.Equal(t, 5, flaky.calls)
+		require.Len(t, *sleeps, 4)
+		for i, maxDelay := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+			require.LessOrEqual(t, (*sleeps)[i], maxDelay)
+			require.GreaterOrEqual(t, (*sleeps)[i], maxDelay/2)
+		}
+		require.Equal(t, []byte("a test"), must(r.ReadFile("test.txt")))
+	})
+
+	t.Run("MaxAttempts", func(t *testing.T) {
+		r, flaky, _ := newTestRetry(t, RetryConfig{MaxAttempts: 3})
+		flaky.failures = 3
+		err := r.WriteFile("test.txt", []byte("a test"))
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		require.ErrorContains(t, err, "gave up after 3 attempts")
+		require.Equal(t, 3, flaky.calls)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		r, flaky, sleeps := newTestRetry(t, RetryConfig{MaxAttempts: 100, InitialDelay: "10s", MaxDelay: "10s", Deadline: "25s"})
+		flaky.failures = 100
+		require.ErrorContains(t, r.WriteFile("test.txt", []byte("a test")), "deadline of 25s exceeded")
+		var total time.Duration
+		for _, d := range *sleeps {
+			total += d
+		}
+		require.LessOrEqual(t, total, 25*time.Second)
+	})
+
+	t.Run("PermanentError", func(t *testing.T) {
+		r, flaky, sleeps := newTestRetry(t, RetryConfig{})
+		_, err := r.ReadFile("missing.txt")
+		require.True(t, r.IsNotExists(err))
+		require.True(t, os.IsNotExist(err))
+		require.Equal(t, 1, flaky.calls)
+		require.Empty(t, *sleeps)
+	})
+
+	t.Run("UntrustedCertificate", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.NotFoundHandler())
+		defer srv.Close()
+		r := must(NewRetry(must(NewWebDAV(WebDAVConfig{URL: srv.URL})), "test", RetryConfig{}))
+		var sleeps []time.Duration
+		r.sleep = func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		}
+		_, err := r.ReadFile("test.txt")
+		require.ErrorContains(t, err, "certificate")
+		require.NotContains(t, err.Error(), "gave up")
+		require.Empty(t, sleeps)
+	})
+
+	t.Run("DeleteFile", func(t *testing.T) {
+		r, flaky, _ := newTestRetry(t, RetryConfig{})
+		require.NoError(t, r.WriteFile("test.txt", []byte("a test")))
+		flaky.failures = 1
+		require.NoError(t, r.DeleteFile("test.txt"))
+		require.False(t, must(r.FileExists("test.txt")))
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		r, flaky, _ := newTestRetry(t, RetryConfig{})
+		require.NoError(t, r.WriteFile("test.txt", []byte("0123456789")))
+		rc := must(r.OpenReader("test.txt", 2, 6))
+		buf := make([]byte, 2)
+		must(io.ReadFull(rc, buf))
+		flaky.failures = 2
+		rest := must(io.ReadAll(rc))
+		require.NoError(t, rc.Close())
+		require.Equal(t, "234567", string(buf)+string(rest))
+	})
+
+	t.Run("Writer", func(t *testing.T) {
+		r, flaky, _ := newTestRetry(t, RetryConfig{})
+		w := must(r.OpenWriter("test.txt"))
+		must(w.Write([]byte("01234")))
+		flaky.failures = 2
+		must(w.Write([]byte("56789")))
+		require.NoError(t, w.Close())
+		require.Equal(t, []byte("0123456789"), must(r.ReadFile("test.txt")))
+		require.Equal(t, []FileInfo{{Name: "test.txt", Size: 10}}, must(r.ReadDir("")))
+
+		flaky.failures = 100
+		w = must(r.OpenWriter("test.txt"))
+		_, err := w.Write([]byte("replaced"))
+		require.Error(t, err)
+		require.Error(t, w.Close())
+		flaky.failures = 0
+		require.Equal(t, []byte("0123456789"), must(r.ReadFile("test.txt")))
+
+		// larger files are not kept in memory and cannot be written again
+		r.replaySize = 10
+		w = must(r.OpenWriter("large.bin"))
+		must(w.Write([]byte("0123456789")))
+		require.Equal(t, 10, w.(*retryWriter).data.Len())
+		must(w.Write([]byte{1}))
+		require.Zero(t, w.(*retryWriter).data.Len())
+		flaky.failures = 1
+		_, err = w.Write([]byte{2})
+		require.Error(t, err)
+		require.Error(t, w.Close())
+		flaky.failures = 0
+		require.False(t, must(r.FileExists("large.bin")))
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		_, err := NewRetry(nil, "test", RetryConfig{InitialDelay: "soon"})
+		require.ErrorContains(t, err, "InitialDelay")
+		_, err = NewRetry(nil, "test", RetryConfig{MaxAttempts: -1})
+		require.Error(t, err)
+	})
+}
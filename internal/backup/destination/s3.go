@@ -0,0 +1,274 @@
+package destination
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	// Endpoint is the host and optional port of the S3 API, e.g. "s3.eu-central-1.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to all object keys.
+	Prefix string
+	// AccessKeyID and SecretAccessKey are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables if empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	// DisableTLS connects via plain HTTP.
+	DisableTLS bool
+	// PathStyle addresses the bucket as part of the path instead of the host name.
+	PathStyle bool
+}
+
+// S3 stores files as objects in an S3-compatible bucket. Directories only exist as key prefixes, so CreateDir is a no-op and ReadDir of a missing directory is empty.
+type S3 struct {
+	conf   S3Config
+	client *minio.Client
+}
+
+func NewS3(conf S3Config) (*S3, error) {
+	if len(conf.Endpoint) == 0 {
+		return nil, fmt.Errorf("missing endpoint")
+	}
+	if len(conf.Bucket) == 0 {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	creds := credentials.NewStaticV4(conf.AccessKeyID, conf.SecretAccessKey, "")
+	if len(conf.AccessKeyID) == 0 {
+		creds = credentials.NewEnvAWS()
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if conf.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !conf.DisableTLS,
+		Region:       conf.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{conf: conf, client: client}, nil
+}
+
+func (d *S3) getKey(relPath string) string {
+	return strings.Trim(path.Join(d.conf.Prefix, relPath), "/")
+}
+
+// getDirPrefix returns the key prefix of all objects in the directory relPath.
+func (d *S3) getDirPrefix(relPath string) string {
+	key := d.getKey(relPath)
+	if len(key) == 0 {
+		return ""
+	}
+	return key + "/"
+}
+
+func (d *S3) ReadDir(relPath string) ([]FileInfo, error) {
+	prefix := d.getDirPrefix(relPath)
+	fis := make([]FileInfo, 0)
+	for obj := range d.client.ListObjects(context.Background(), d.conf.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if len(name) == 0 {
+			// directory marker
+			continue
+		}
+		if dirName, ok := strings.CutSuffix(name, "/"); ok {
+			fis = append(fis, FileInfo{Name: dirName, IsDir: true})
+		} else {
+			fis = append(fis, FileInfo{Name: name, Size: obj.Size})
+		}
+	}
+	return fis, nil
+}
+
+func (d *S3) FileExists(relPath string) (bool, error) {
+	_, err := d.client.StatObject(context.Background(), d.conf.Bucket, d.getKey(relPath), minio.StatObjectOptions{})
+	if err != nil {
+		if d.IsNotExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *S3) ReadFile(relPath string) ([]byte, error) {
+	obj, err := d.client.GetObject(context.Background(), d.conf.Bucket, d.getKey(relPath), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+func (d *S3) WriteFile(relPath string, data []byte) error {
+	_, err := d.client.PutObject(context.Background(), d.conf.Bucket, d.getKey(relPath), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+func (d *S3) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if length == 0 {
+		// empty ranges cannot be requested, but the object must still exist
+		if _, err := d.client.StatObject(context.Background(), d.conf.Bucket, d.getKey(relPath), minio.StatObjectOptions{}); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if offset > 0 || length > 0 {
+		end := int64(0)
+		if length > 0 {
+			end = offset + length - 1
+		}
+		if err := opts.SetRange(offset, end); err != nil {
+			return nil, err
+		}
+	}
+	// the core client sends the request right away and reports missing objects immediately
+	obj, _, _, err := minio.Core{Client: d.client}.GetObject(context.Background(), d.conf.Bucket, d.getKey(relPath), opts)
+	return obj, err
+}
+
+// s3PartSize is the part size of streamed uploads. Each part is buffered in memory, the default for unknown sizes would be more than 500 MiB.
+const s3PartSize = 16 * 1024 * 1024
+
+// OpenWriter collects up to one part in memory and uploads it with a single request when the writer is closed. Larger objects are streamed into a multipart upload that is completed on Close. The payload of multipart uploads is not signed, because streaming signatures are not supported by all S3-compatible servers.
+func (d *S3) OpenWriter(relPath string) (io.WriteCloser, error) {
+	return &s3Writer{d: d, relPath: relPath}, nil
+}
+
+type s3Writer struct {
+	d       *S3
+	relPath string
+	// buf holds the data until it exceeds a single part.
+	buf bytes.Buffer
+	// pw is set once the data is streamed into a multipart upload.
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.pw == nil {
+		if w.buf.Len()+len(p) <= s3PartSize {
+			return w.buf.Write(p)
+		}
+		w.startUpload()
+		if _, err := w.pw.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf = bytes.Buffer{}
+	}
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) startUpload() {
+	pr, pw := io.Pipe()
+	w.pw, w.done = pw, make(chan error, 1)
+	go func() {
+		_, err := w.d.client.PutObject(context.Background(), w.d.conf.Bucket, w.d.getKey(w.relPath), pr, -1, minio.PutObjectOptions{PartSize: s3PartSize, DisableContentSha256: true})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+func (w *s3Writer) Close() error {
+	if w.pw == nil {
+		return w.d.WriteFile(w.relPath, w.buf.Bytes())
+	}
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// Abort cancels the upload, so no object is created.
+func (w *s3Writer) Abort() error {
+	if w.pw == nil {
+		w.buf = bytes.Buffer{}
+		return nil
+	}
+	w.pw.CloseWithError(errAborted)
+	<-w.done
+	return nil
+}
+
+// DeleteDir removes all objects below relPath with batched delete requests. Like for local directories, a single file can also be removed. The root of a bucket without prefix is never deleted, because that would remove every object of the bucket.
+func (d *S3) DeleteDir(relPath string) error {
+	if len(d.getKey(relPath)) == 0 {
+		return fmt.Errorf("refusing to delete the whole bucket %q", d.conf.Bucket)
+	}
+
+	objects := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objects)
+		objects <- minio.ObjectInfo{Key: d.getKey(relPath)}
+		for obj := range d.client.ListObjects(context.Background(), d.conf.Bucket, minio.ListObjectsOptions{Prefix: d.getDirPrefix(relPath), Recursive: true}) {
+			if obj.Err != nil {
+				listErr <- obj.Err
+				return
+			}
+			objects <- obj
+		}
+		listErr <- nil
+	}()
+
+	var errs []error
+	for result := range d.client.RemoveObjects(context.Background(), d.conf.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && !d.IsNotExists(result.Err) {
+			errs = append(errs, fmt.Errorf("delete %q: %w", result.ObjectName, result.Err))
+		}
+	}
+	errs = append(errs, <-listErr)
+	return errors.Join(errs...)
+}
+
+func (d *S3) DeleteFile(relPath string) error {
+	return d.client.RemoveObject(context.Background(), d.conf.Bucket, d.getKey(relPath), minio.RemoveObjectOptions{})
+}
+
+func (d *S3) CreateDir(relPath string) error {
+	return nil
+}
+
+// Close does nothing, because requests do not keep a session open.
+func (d *S3) Close() error {
+	return nil
+}
+
+func (d *S3) IsNotExists(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// IsTransient reports server errors and throttling that may succeed on a retry.
+func (d *S3) IsTransient(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return resp.StatusCode != 0 && isTransientHTTPStatus(resp.StatusCode)
+}
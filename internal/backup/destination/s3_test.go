@@ -0,0 +1,85 @@
+package destination
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3(t *testing.T) {
+	backend := s3mem.New()
+	require.NoError(t, backend.CreateBucket("keepr"))
+	srv := httptest.NewServer(gofakes3.New(backend).Server())
+	defer srv.Close()
+	endpoint := must(url.Parse(srv.URL)).Host
+
+	for _, prefix := range []string{"", "backups/set1"} {
+		t.Run("Prefix="+prefix, func(t *testing.T) {
+			d := must(NewS3(S3Config{Endpoint: endpoint, Bucket: "keepr", Prefix: prefix, Region: "us-east-1", AccessKeyID: "key", SecretAccessKey: "secret", DisableTLS: true, PathStyle: true}))
+
+			require.Equal(t, []FileInfo{}, must(d.ReadDir("/")))
+			require.False(t, must(d.FileExists("test.txt")))
+			require.NoError(t, d.WriteFile("test.txt", []byte("a test")))
+			require.True(t, must(d.FileExists("test.txt")))
+			require.Equal(t, []byte("a test"), must(d.ReadFile("test.txt")))
+			require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+			require.NoError(t, d.CreateDir("subdir"))
+			require.False(t, must(d.FileExists("subdir/stuff.txt")))
+			require.NoError(t, d.WriteFile("subdir/stuff.txt", []byte("täßt")))
+			require.True(t, must(d.FileExists("subdir/stuff.txt")))
+			require.Equal(t, []byte("täßt"), must(d.ReadFile("subdir/stuff.txt")))
+			require.Equal(t, []FileInfo{{Name: "stuff.txt", IsDir: false, Size: 6}}, must(d.ReadDir("subdir")))
+			dirContent := must(d.ReadDir("/"))
+			require.Len(t, dirContent, 2)
+			require.Contains(t, dirContent, FileInfo{Name: "test.txt", IsDir: false, Size: 6})
+			require.Contains(t, dirContent, FileInfo{Name: "subdir", IsDir: true})
+
+			// more objects than fit into a single delete batch
+			for i := range 1100 {
+				require.NoError(t, d.WriteFile(fmt.Sprintf("many/%c/%04d", 'a'+i%26, i), []byte{byte(i)}))
+			}
+			require.Len(t, must(d.ReadDir("many")), 26)
+			require.NoError(t, d.DeleteDir("many"))
+			require.Equal(t, []FileInfo{}, must(d.ReadDir("many")))
+
+			require.NoError(t, d.DeleteFile("subdir/stuff.txt"))
+			require.False(t, must(d.FileExists("subdir/stuff.txt")))
+			require.NoError(t, d.WriteFile("subdir/stuff.txt", []byte("again")))
+			require.NoError(t, d.DeleteDir("subdir"))
+			require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+			_, err := d.ReadFile("missing.txt")
+			require.True(t, d.IsNotExists(err))
+
+			testStreams(t, d)
+
+			// larger streams are uploaded in multiple parts
+			w := must(d.OpenWriter("large.bin"))
+			must(w.Write(make([]byte, s3PartSize)))
+			must(w.Write([]byte{1}))
+			require.NoError(t, w.Close())
+			require.Len(t, must(d.ReadFile("large.bin")), s3PartSize+1)
+			require.NoError(t, d.DeleteFile("large.bin"))
+			w = must(d.OpenWriter("aborted.bin"))
+			must(w.Write([]byte("incomplete")))
+			require.NoError(t, Abort(w))
+			require.False(t, must(d.FileExists("aborted.bin")))
+
+			if len(prefix) == 0 {
+				for _, relPath := range []string{"", "/"} {
+					require.ErrorContains(t, d.DeleteDir(relPath), "whole bucket")
+				}
+				require.True(t, must(d.FileExists("test.txt")))
+			}
+
+			require.NoError(t, d.DeleteDir("test.txt"))
+			require.Equal(t, []FileInfo{}, must(d.ReadDir("/")))
+		})
+	}
+}
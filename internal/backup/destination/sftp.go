@@ -0,0 +1,358 @@
+package destination
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/adrg/xdg"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPConfig struct {
+	Host string
+	// Port defaults to 22.
+	Port int
+	User string
+	// KeyFile is the path of a private key in OpenSSH format. Password is used if no key file is given.
+	KeyFile  string
+	Password string
+	// Path is the base directory on the server.
+	Path string
+	// KnownHostsFile is used to verify the host key and defaults to ~/.ssh/known_hosts.
+	KnownHostsFile string
+}
+
+type SFTP struct {
+	conf      SFTPConfig
+	addr      string
+	sshConfig *ssh.ClientConfig
+
+	// mutex guards the connection, which is dialed again by the next operation after it was lost.
+	mutex  sync.Mutex
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTP(conf SFTPConfig) (*SFTP, error) {
+	if len(conf.Host) == 0 {
+		return nil, fmt.Errorf("missing host")
+	}
+	if conf.Port == 0 {
+		conf.Port = 22
+	}
+
+	auth := make([]ssh.AuthMethod, 0)
+	if len(conf.KeyFile) > 0 {
+		keyData, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(keyData)
+		if err != nil {
+			return nil, fmt.Errorf("parse key file: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(conf.Password) > 0 {
+		auth = append(auth, ssh.Password(conf.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("missing key file or password")
+	}
+
+	knownHostsFile := conf.KnownHostsFile
+	if len(knownHostsFile) == 0 {
+		knownHostsFile = filepath.Join(xdg.Home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+
+	d := &SFTP{
+		conf: conf,
+		addr: net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+		sshConfig: &ssh.ClientConfig{
+			User:            conf.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+	}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// connect dials the server and starts a new SFTP session. The mutex must be held.
+func (d *SFTP) connect() error {
+	sshClient, err := ssh.Dial("tcp", d.addr, d.sshConfig)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", d.conf.Host, err)
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return fmt.Errorf("start sftp session: %w", err)
+	}
+	d.ssh, d.client = sshClient, client
+
+	go func() {
+		// operations fail with ErrSSHFxConnectionLost until the connection is dropped here
+		sshClient.Wait()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.ssh == sshClient {
+			client.Close()
+			d.ssh, d.client = nil, nil
+		}
+	}()
+	return nil
+}
+
+// getClient returns the client of the current connection and dials a new one if it was lost.
+func (d *SFTP) getClient() (*sftp.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.client == nil {
+		if err := d.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return d.client, nil
+}
+
+// Close terminates the SFTP session and the underlying SSH connection.
+func (d *SFTP) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := errors.Join(d.client.Close(), d.ssh.Close())
+	d.ssh, d.client = nil, nil
+	return err
+}
+
+func (d *SFTP) getRemotePath(relPath string) string {
+	return path.Join(d.conf.Path, relPath)
+}
+
+func (d *SFTP) ReadDir(relPath string) ([]FileInfo, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	files, err := client.ReadDir(d.getRemotePath(relPath))
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]FileInfo, 0, len(files))
+	for _, fi := range files {
+		if fi.Name() != "." && fi.Name() != ".." {
+			var size int64
+			if !fi.IsDir() {
+				size = fi.Size()
+			}
+			fis = append(fis, FileInfo{
+				Name:  fi.Name(),
+				IsDir: fi.IsDir(),
+				Size:  size,
+			})
+		}
+	}
+	return fis, nil
+}
+
+func (d *SFTP) FileExists(relPath string) (bool, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return false, err
+	}
+	fi, err := client.Stat(d.getRemotePath(relPath))
+	if err != nil {
+		if d.IsNotExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if fi.IsDir() {
+		return false, fmt.Errorf("expected file, but %q is a directory", relPath)
+	}
+	return true, nil
+}
+
+func (d *SFTP) ReadFile(relPath string) ([]byte, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(d.getRemotePath(relPath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (d *SFTP) WriteFile(relPath string, data []byte) error {
+	w, err := d.OpenWriter(relPath)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+func (d *SFTP) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(d.getRemotePath(relPath))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// OpenWriter writes to a temporary file next to the target, which is renamed to its final name on Close. Syncing and atomically replacing existing files requires the OpenSSH extensions of the server.
+func (d *SFTP) OpenWriter(relPath string) (io.WriteCloser, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	file := d.getRemotePath(relPath)
+	if err := client.MkdirAll(path.Dir(file)); err != nil {
+		return nil, fmt.Errorf("create parent directory: %w", err)
+	}
+	// every writer uses its own temporary file, so concurrent writers of the same file cannot mix their data
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	f, err := client.OpenFile(file+"."+hex.EncodeToString(suffix)+tempFileSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(filePerm); err != nil {
+		f.Close()
+		client.Remove(f.Name())
+		return nil, err
+	}
+	return &sftpFileWriter{client: client, f: f, path: file}, nil
+}
+
+type sftpFileWriter struct {
+	client *sftp.Client
+	f      *sftp.File
+	path   string
+	failed bool
+}
+
+func (w *sftpFileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *sftpFileWriter) Close() error {
+	if w.failed {
+		w.Abort()
+		return fmt.Errorf("discarded %q after failed write", w.path)
+	}
+	if _, ok := w.client.HasExtension("fsync@openssh.com"); ok {
+		if err := w.f.Sync(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.f.Close(); err != nil {
+		w.client.Remove(w.f.Name())
+		return err
+	}
+
+	var err error
+	if _, ok := w.client.HasExtension("posix-rename@openssh.com"); ok {
+		err = w.client.PosixRename(w.f.Name(), w.path)
+	} else {
+		// plain SFTP rename fails if the target exists
+		if err := w.client.Remove(w.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			w.client.Remove(w.f.Name())
+			return err
+		}
+		err = w.client.Rename(w.f.Name(), w.path)
+	}
+	if err != nil {
+		w.client.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *sftpFileWriter) Abort() error {
+	w.f.Close()
+	return w.client.Remove(w.f.Name())
+}
+
+func (d *SFTP) DeleteDir(relPath string) error {
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	err = client.RemoveAll(d.getRemotePath(relPath))
+	if d.IsNotExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *SFTP) DeleteFile(relPath string) error {
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Remove(d.getRemotePath(relPath))
+}
+
+func (d *SFTP) CreateDir(relPath string) error {
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return client.MkdirAll(d.getRemotePath(relPath))
+}
+
+func (d *SFTP) IsNotExists(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// IsTransient reports lost connections, which are dialed again by the next operation.
+func (d *SFTP) IsTransient(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost)
+}
@@ -0,0 +1,212 @@
+package destination
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSFTP(t *testing.T) {
+	srv := newTestSFTPServer(t)
+
+	t.Run("Password", func(t *testing.T) {
+		dir := t.TempDir()
+		d := must(NewSFTP(SFTPConfig{Host: "127.0.0.1", Port: srv.port, User: "keepr", Password: "secret", Path: dir, KnownHostsFile: srv.knownHostsFile}))
+		defer d.Close()
+
+		require.Equal(t, []FileInfo{}, must(d.ReadDir("/")))
+		require.False(t, must(d.FileExists("test.txt")))
+		require.NoError(t, d.WriteFile("test.txt", []byte("a test")))
+		require.True(t, must(d.FileExists("test.txt")))
+		require.Equal(t, []byte("a test"), must(d.ReadFile("test.txt")))
+		require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+		require.False(t, must(d.FileExists("subdir/stuff.txt")))
+		require.NoError(t, d.WriteFile("subdir/stuff.txt", []byte("täßt")))
+		require.True(t, must(d.FileExists("subdir/stuff.txt")))
+		require.Equal(t, []byte("täßt"), must(d.ReadFile("subdir/stuff.txt")))
+		require.Equal(t, []FileInfo{{Name: "stuff.txt", IsDir: false, Size: 6}}, must(d.ReadDir("subdir")))
+		dirContent := must(d.ReadDir("/"))
+		require.Len(t, dirContent, 2)
+		require.Contains(t, dirContent, FileInfo{Name: "test.txt", IsDir: false, Size: 6})
+		require.Contains(t, dirContent, FileInfo{Name: "subdir", IsDir: true})
+		_, err := d.FileExists("subdir")
+		require.Error(t, err)
+
+		require.NoError(t, d.CreateDir("a/b/c"))
+		require.Equal(t, []FileInfo{{Name: "c", IsDir: true}}, must(d.ReadDir("a/b")))
+		require.NoError(t, d.DeleteDir("a"))
+
+		require.NoError(t, d.DeleteFile("subdir/stuff.txt"))
+		require.True(t, d.IsNotExists(d.DeleteFile("subdir/stuff.txt")))
+		require.NoError(t, d.WriteFile("subdir/stuff.txt", []byte("again")))
+		require.NoError(t, d.DeleteDir("subdir"))
+		require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+		_, err = d.ReadFile("missing.txt")
+		require.True(t, d.IsNotExists(err))
+		_, err = d.ReadDir("missing")
+		require.True(t, d.IsNotExists(err))
+
+		testStreams(t, d)
+		testConcurrentWriters(t, d)
+
+		// the destination operates on the server file system
+		require.Equal(t, []byte("a test"), must(os.ReadFile(filepath.Join(dir, "test.txt"))))
+	})
+
+	t.Run("KeyFile", func(t *testing.T) {
+		d := must(NewSFTP(SFTPConfig{Host: "127.0.0.1", Port: srv.port, User: "keepr", KeyFile: srv.clientKeyFile, Path: t.TempDir(), KnownHostsFile: srv.knownHostsFile}))
+		defer d.Close()
+		require.NoError(t, d.WriteFile("test.txt", []byte("a test")))
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		d := must(NewSFTP(SFTPConfig{Host: "127.0.0.1", Port: srv.port, User: "keepr", Password: "secret", Path: t.TempDir(), KnownHostsFile: srv.knownHostsFile}))
+		defer d.Close()
+		require.NoError(t, d.WriteFile("test.txt", []byte("a test")))
+
+		srv.dropConnections()
+		require.Eventually(t, func() bool {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			return d.client == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, []byte("a test"), must(d.ReadFile("test.txt")))
+		require.True(t, d.IsTransient(&os.PathError{Op: "open", Path: "test.txt", Err: sftp.ErrSSHFxConnectionLost}))
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		_, err := NewSFTP(SFTPConfig{Host: "127.0.0.1", Port: srv.port, User: "keepr", Password: "wrong", Path: t.TempDir(), KnownHostsFile: srv.knownHostsFile})
+		require.Error(t, err)
+	})
+
+	t.Run("UnknownHost", func(t *testing.T) {
+		knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+		require.NoError(t, os.WriteFile(knownHostsFile, nil, 0600))
+		_, err := NewSFTP(SFTPConfig{Host: "127.0.0.1", Port: srv.port, User: "keepr", Password: "secret", Path: t.TempDir(), KnownHostsFile: knownHostsFile})
+		require.ErrorContains(t, err, "knownhosts")
+	})
+}
+
+type testSFTPServer struct {
+	port           int
+	knownHostsFile string
+	clientKeyFile  string
+
+	connsMutex sync.Mutex
+	conns      []net.Conn
+}
+
+// dropConnections closes all client connections like a lost network connection.
+func (srv *testSFTPServer) dropConnections() {
+	srv.connsMutex.Lock()
+	defer srv.connsMutex.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+// newTestSFTPServer starts an in-process SSH server that serves the local file system via SFTP.
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	_, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner := must(ssh.NewSignerFromKey(hostPrivateKey))
+
+	clientPublicKey, clientPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientSSHPublicKey := must(ssh.NewPublicKey(clientPublicKey))
+
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "keepr" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "keepr" && string(key.Marshal()) == string(clientSSHPublicKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	conf.AddHostKey(hostSigner)
+
+	srv := &testSFTPServer{}
+	listener := must(net.Listen("tcp", "127.0.0.1:0"))
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.connsMutex.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.connsMutex.Unlock()
+			go serveTestSFTPConn(conn, conf)
+		}
+	}()
+
+	dir := t.TempDir()
+	port := listener.Addr().(*net.TCPAddr).Port
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("127.0.0.1:" + strconv.Itoa(port))}, hostSigner.PublicKey())
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	clientKeyFile := filepath.Join(dir, "id_ed25519")
+	block := must(ssh.MarshalPrivateKey(clientPrivateKey, ""))
+	require.NoError(t, os.WriteFile(clientKeyFile, pem.EncodeToMemory(block), 0600))
+
+	srv.port, srv.knownHostsFile, srv.clientKeyFile = port, knownHostsFile, clientKeyFile
+	return srv
+}
+
+func serveTestSFTPConn(conn net.Conn, conf *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if isSFTP {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					server.Close()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,397 @@
+package destination
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type WebDAVConfig struct {
+	// URL of the base directory, e.g. "https://cloud.example.com/remote.php/dav/files/me/backups".
+	URL      string
+	User     string
+	Password string
+	// CAFile is a PEM file with additional certificates to trust.
+	CAFile string
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool
+}
+
+type WebDAV struct {
+	conf    WebDAVConfig
+	baseURL *url.URL
+	client  *http.Client
+
+	// createdDirs contains the collections that are known to exist, so writes do not send MKCOL for every parent again.
+	createdDirsMutex sync.Mutex
+	createdDirs      map[string]bool
+}
+
+func NewWebDAV(conf WebDAVConfig) (*WebDAV, error) {
+	baseURL, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", baseURL.Scheme)
+	}
+	baseURL.Path = strings.TrimRight(baseURL.Path, "/")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if len(conf.CAFile) > 0 {
+		pemData, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("ca file contains no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &WebDAV{
+		conf:        conf,
+		baseURL:     baseURL,
+		client:      &http.Client{Transport: transport},
+		createdDirs: make(map[string]bool),
+	}, nil
+}
+
+// webDAVStatusError is returned for unexpected response codes and matches os.ErrNotExist for 404.
+type webDAVStatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (err *webDAVStatusError) Error() string {
+	return fmt.Sprintf("%s %q: %d %s", err.Method, err.Path, err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+func (err *webDAVStatusError) Is(target error) bool {
+	return target == os.ErrNotExist && err.StatusCode == http.StatusNotFound
+}
+
+func (d *WebDAV) getURL(relPath string, isDir bool) string {
+	u := *d.baseURL
+	u.Path = path.Join(u.Path, relPath)
+	if isDir {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (d *WebDAV) do(method, relPath string, isDir bool, header http.Header, body io.Reader, expectedStatus ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, d.getURL(relPath, isDir), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if len(d.conf.User) > 0 {
+		req.SetBasicAuth(d.conf.User, d.conf.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expectedStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil, &webDAVStatusError{Method: method, Path: relPath, StatusCode: resp.StatusCode}
+}
+
+type davMultiStatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	PropStat []davPropStat `xml:"DAV: propstat"`
+}
+
+type davPropStat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/></d:prop></d:propfind>`
+
+// propfind returns the properties of relPath and, for depth 1, of its direct children.
+func (d *WebDAV) propfind(relPath string, depth int) (map[string]FileInfo, error) {
+	header := http.Header{
+		"Depth":        []string{strconv.Itoa(depth)},
+		"Content-Type": []string{"application/xml; charset=utf-8"},
+	}
+	resp, err := d.do("PROPFIND", relPath, depth > 0, header, strings.NewReader(propfindBody), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms davMultiStatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("parse PROPFIND response: %w", err)
+	}
+
+	fis := make(map[string]FileInfo, len(ms.Responses))
+	for _, r := range ms.Responses {
+		hrefURL, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("parse href %q: %w", r.Href, err)
+		}
+		hrefPath := strings.TrimRight(hrefURL.Path, "/")
+
+		var fi FileInfo
+		fi.Name = path.Base(hrefPath)
+		for _, ps := range r.PropStat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				fi.IsDir = true
+			}
+			if len(ps.Prop.ContentLength) > 0 {
+				fi.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+		}
+		if fi.IsDir {
+			fi.Size = 0
+		}
+		fis[hrefPath] = fi
+	}
+	return fis, nil
+}
+
+func (d *WebDAV) ReadDir(relPath string) ([]FileInfo, error) {
+	entries, err := d.propfind(relPath, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath := strings.TrimRight(path.Join(d.baseURL.Path, relPath), "/")
+	fis := make([]FileInfo, 0, len(entries))
+	for hrefPath, fi := range entries {
+		if hrefPath != dirPath {
+			fis = append(fis, fi)
+		}
+	}
+	return fis, nil
+}
+
+func (d *WebDAV) FileExists(relPath string) (bool, error) {
+	entries, err := d.propfind(relPath, 0)
+	if err != nil {
+		if d.IsNotExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, fi := range entries {
+		if fi.IsDir {
+			return false, fmt.Errorf("expected file, but %q is a directory", relPath)
+		}
+	}
+	return true, nil
+}
+
+func (d *WebDAV) ReadFile(relPath string) ([]byte, error) {
+	resp, err := d.do(http.MethodGet, relPath, false, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (d *WebDAV) WriteFile(relPath string, data []byte) error {
+	if err := d.CreateDir(path.Dir(path.Join("/", relPath))); err != nil {
+		return fmt.Errorf("create parent directory: %w", err)
+	}
+	resp, err := d.do(http.MethodPut, relPath, false, nil, bytes.NewReader(data), http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// OpenReader requests the range from the server. Servers that ignore range requests are handled by skipping the leading data.
+func (d *WebDAV) OpenReader(relPath string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 && length < 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.do(http.MethodGet, relPath, false, header, nil, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK && offset > 0 {
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return resp.Body, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+}
+
+// OpenWriter streams the written data as request body of a single PUT request.
+func (d *WebDAV) OpenWriter(relPath string) (io.WriteCloser, error) {
+	if err := d.CreateDir(path.Dir(path.Join("/", relPath))); err != nil {
+		return nil, fmt.Errorf("create parent directory: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	w := &webDAVWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := d.do(http.MethodPut, relPath, false, nil, pr, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			err = resp.Body.Close()
+		}
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type webDAVWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *webDAVWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *webDAVWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// Abort cancels the upload, so no object is created.
+func (w *webDAVWriter) Abort() error {
+	w.pw.CloseWithError(errAborted)
+	<-w.done
+	return nil
+}
+
+func (d *WebDAV) DeleteDir(relPath string) error {
+	d.forgetCreatedDirs(relPath)
+	resp, err := d.do(http.MethodDelete, relPath, false, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if d.IsNotExists(err) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (d *WebDAV) DeleteFile(relPath string) error {
+	resp, err := d.do(http.MethodDelete, relPath, false, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CreateDir creates relPath and all missing parents with MKCOL. Collections created before by this client are skipped.
+func (d *WebDAV) CreateDir(relPath string) error {
+	dir := cleanDirPath(relPath)
+	if len(dir) == 0 {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		d.createdDirsMutex.Lock()
+		created := d.createdDirs[dir]
+		d.createdDirsMutex.Unlock()
+		if created {
+			continue
+		}
+
+		// 405 Method Not Allowed is returned for existing collections
+		resp, err := d.do("MKCOL", dir, true, nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		d.createdDirsMutex.Lock()
+		d.createdDirs[dir] = true
+		d.createdDirsMutex.Unlock()
+	}
+	return nil
+}
+
+// forgetCreatedDirs removes relPath and all collections below it from createdDirs.
+func (d *WebDAV) forgetCreatedDirs(relPath string) {
+	dir := cleanDirPath(relPath)
+	d.createdDirsMutex.Lock()
+	defer d.createdDirsMutex.Unlock()
+	for created := range d.createdDirs {
+		if len(dir) == 0 || created == dir || strings.HasPrefix(created, dir+"/") {
+			delete(d.createdDirs, created)
+		}
+	}
+}
+
+// cleanDirPath returns relPath without leading and trailing slashes, which is empty for the base directory.
+func cleanDirPath(relPath string) string {
+	return strings.Trim(path.Clean("/"+relPath), "/")
+}
+
+// Close closes idle keep-alive connections to the server.
+func (d *WebDAV) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+func (d *WebDAV) IsNotExists(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// IsTransient reports server errors and rate limiting responses that may succeed on a retry.
+func (d *WebDAV) IsTransient(err error) bool {
+	var statusErr *webDAVStatusError
+	return errors.As(err, &statusErr) && isTransientHTTPStatus(statusErr.StatusCode)
+}
@@ -0,0 +1,110 @@
+package destination
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	dir := t.TempDir()
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	var mkcolCount atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "keepr" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "MKCOL" {
+			mkcolCount.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "backups"), 0700))
+
+	d := must(NewWebDAV(WebDAVConfig{URL: srv.URL + "/dav/backups", User: "keepr", Password: "secret", CAFile: caFile}))
+
+	require.Equal(t, []FileInfo{}, must(d.ReadDir("/")))
+	require.False(t, must(d.FileExists("test.txt")))
+	require.NoError(t, d.WriteFile("test.txt", []byte("a test")))
+	require.True(t, must(d.FileExists("test.txt")))
+	require.Equal(t, []byte("a test"), must(d.ReadFile("test.txt")))
+	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+	require.False(t, must(d.FileExists("sub dir/stüff.txt")))
+	require.NoError(t, d.WriteFile("sub dir/stüff.txt", []byte("täßt")))
+	require.True(t, must(d.FileExists("sub dir/stüff.txt")))
+	require.Equal(t, []byte("täßt"), must(d.ReadFile("sub dir/stüff.txt")))
+	require.Equal(t, []FileInfo{{Name: "stüff.txt", IsDir: false, Size: 6}}, must(d.ReadDir("sub dir")))
+	dirContent := must(d.ReadDir("/"))
+	require.Len(t, dirContent, 2)
+	require.Contains(t, dirContent, FileInfo{Name: "test.txt", IsDir: false, Size: 6})
+	require.Contains(t, dirContent, FileInfo{Name: "sub dir", IsDir: true})
+	_, err := d.FileExists("sub dir")
+	require.Error(t, err)
+
+	require.NoError(t, d.CreateDir("a/b/c"))
+	require.NoError(t, d.CreateDir("a/b/c"))
+	require.Equal(t, []FileInfo{{Name: "c", IsDir: true}}, must(d.ReadDir("a/b")))
+	require.NoError(t, d.DeleteDir("a"))
+	require.NoError(t, d.DeleteDir("a"))
+
+	require.NoError(t, d.DeleteFile("sub dir/stüff.txt"))
+	require.True(t, d.IsNotExists(d.DeleteFile("sub dir/stüff.txt")))
+	require.NoError(t, d.DeleteDir("sub dir"))
+	require.Equal(t, []FileInfo{{Name: "test.txt", IsDir: false, Size: 6}}, must(d.ReadDir("/")))
+
+	_, err = d.ReadFile("missing.txt")
+	require.True(t, d.IsNotExists(err))
+	_, err = d.ReadDir("missing")
+	require.True(t, d.IsNotExists(err))
+
+	testStreams(t, d)
+
+	require.Equal(t, []byte("a test"), must(os.ReadFile(filepath.Join(dir, "backups", "test.txt"))))
+
+	t.Run("CreatedDirs", func(t *testing.T) {
+		mkcolCount.Store(0)
+		require.NoError(t, d.WriteFile("x/y/1", []byte("1")))
+		require.NoError(t, d.WriteFile("x/y/2", []byte("2")))
+		require.NoError(t, d.WriteFile("x/3", []byte("3")))
+		require.Equal(t, int32(2), mkcolCount.Load())
+
+		// deleted collections are created again
+		require.NoError(t, d.DeleteDir("x"))
+		require.NoError(t, d.WriteFile("x/y/1", []byte("1")))
+		require.Equal(t, int32(4), mkcolCount.Load())
+		require.Equal(t, []byte("1"), must(d.ReadFile("x/y/1")))
+		require.NoError(t, d.DeleteDir("x"))
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		d := must(NewWebDAV(WebDAVConfig{URL: srv.URL + "/dav/backups", User: "keepr", Password: "wrong", CAFile: caFile}))
+		_, err := d.ReadDir("/")
+		require.ErrorContains(t, err, "401")
+	})
+
+	t.Run("UntrustedCertificate", func(t *testing.T) {
+		d := must(NewWebDAV(WebDAVConfig{URL: srv.URL + "/dav/backups", User: "keepr", Password: "secret"}))
+		_, err := d.ReadDir("/")
+		require.ErrorContains(t, err, "certificate")
+
+		d = must(NewWebDAV(WebDAVConfig{URL: srv.URL + "/dav/backups", User: "keepr", Password: "secret", InsecureSkipVerify: true}))
+		require.Len(t, must(d.ReadDir("/")), 1)
+	})
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"sort"
+	"strings"
+)
+
+type SnapshotDiff struct {
+	Added    []FileDiff
+	Removed  []FileDiff
+	Modified []FileDiff
+	Renamed  []FileRename
+	// SizeDelta is the difference of the total snapshot sizes.
+	SizeDelta int64
+}
+
+type FileDiff struct {
+	Path      string
+	OldSize   uint64
+	NewSize   uint64
+	SizeDelta int64
+}
+
+type FileRename struct {
+	OldPath string
+	NewPath string
+	Size    uint64
+}
+
+// DiffSnapshots compares the files and symlinks of snapshot a to snapshot b. Files are considered modified if their content differs, symlinks if their target differs. Removed and added files with identical blobs are reported as renamed.
+func DiffSnapshots(a, b *Snapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		Added:     make([]FileDiff, 0),
+		Removed:   make([]FileDiff, 0),
+		Modified:  make([]FileDiff, 0),
+		Renamed:   make([]FileRename, 0),
+		SizeDelta: int64(b.TotalSize) - int64(a.TotalSize),
+	}
+
+	removed := make(map[string]FileSnapshot)
+	for path, oldFile := range a.Files {
+		if oldFile.IsDir() {
+			continue
+		}
+		newFile, ok := b.Files[path]
+		if !ok || newFile.IsDir() {
+			removed[path] = oldFile
+			continue
+		}
+		if oldFile.Mode.Type() != newFile.Mode.Type() || oldFile.LinkTarget != newFile.LinkTarget || oldFile.Size != newFile.Size || !equalBlobs(oldFile.Blobs, newFile.Blobs) {
+			diff.Modified = append(diff.Modified, newFileDiff(path, oldFile.Size, newFile.Size))
+		}
+	}
+
+	added := make(map[string]FileSnapshot)
+	for path, newFile := range b.Files {
+		if newFile.IsDir() {
+			continue
+		}
+		if oldFile, ok := a.Files[path]; !ok || oldFile.IsDir() {
+			added[path] = newFile
+		}
+	}
+
+	// empty files share the same (empty) blob list and are never matched as renames
+	removedByContent := make(map[string][]string)
+	for _, path := range sortedPaths(removed) {
+		if f := removed[path]; f.Size > 0 {
+			key := blobsKey(f.Blobs)
+			removedByContent[key] = append(removedByContent[key], path)
+		}
+	}
+	for _, path := range sortedPaths(added) {
+		f := added[path]
+		if f.Size == 0 {
+			continue
+		}
+		key := blobsKey(f.Blobs)
+		if candidates := removedByContent[key]; len(candidates) > 0 {
+			diff.Renamed = append(diff.Renamed, FileRename{OldPath: candidates[0], NewPath: path, Size: f.Size})
+			removedByContent[key] = candidates[1:]
+			delete(removed, candidates[0])
+			delete(added, path)
+		}
+	}
+
+	for _, path := range sortedPaths(added) {
+		diff.Added = append(diff.Added, newFileDiff(path, 0, added[path].Size))
+	}
+	for _, path := range sortedPaths(removed) {
+		diff.Removed = append(diff.Removed, newFileDiff(path, removed[path].Size, 0))
+	}
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].Path < diff.Modified[j].Path
+	})
+
+	return diff
+}
+
+func newFileDiff(path string, oldSize, newSize uint64) FileDiff {
+	return FileDiff{
+		Path:      path,
+		OldSize:   oldSize,
+		NewSize:   newSize,
+		SizeDelta: int64(newSize) - int64(oldSize),
+	}
+}
+
+func equalBlobs(a, b []BlobID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func blobsKey(blobs []BlobID) string {
+	var sb strings.Builder
+	for _, id := range blobs {
+		sb.Write(id[:])
+	}
+	return sb.String()
+}
+
+func sortedPaths(files map[string]FileSnapshot) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	blobA := BlobID{1}
+	blobB := BlobID{2}
+	blobC := BlobID{3}
+	blobD := BlobID{4}
+
+	a := &Snapshot{
+		TotalSize: 60,
+		Files: map[string]FileSnapshot{
+			"unchanged.txt": {Path: "unchanged.txt", Size: 10, Blobs: []BlobID{blobA}},
+			"modified.txt":  {Path: "modified.txt", Size: 10, Blobs: []BlobID{blobB}},
+			"removed.txt":   {Path: "removed.txt", Size: 20, Blobs: []BlobID{blobC}},
+			"old/moved.txt": {Path: "old/moved.txt", Size: 20, Blobs: []BlobID{blobD}},
+			"empty.txt":     {Path: "empty.txt", Size: 0},
+		},
+	}
+	b := &Snapshot{
+		TotalSize: 65,
+		Files: map[string]FileSnapshot{
+			"unchanged.txt": {Path: "unchanged.txt", Size: 10, Blobs: []BlobID{blobA}},
+			"modified.txt":  {Path: "modified.txt", Size: 15, Blobs: []BlobID{blobC}},
+			"new/moved.txt": {Path: "new/moved.txt", Size: 20, Blobs: []BlobID{blobD}},
+			"added.txt":     {Path: "added.txt", Size: 20, Blobs: []BlobID{blobA, blobB}},
+			"empty2.txt":    {Path: "empty2.txt", Size: 0},
+		},
+	}
+
+	diff := DiffSnapshots(a, b)
+	require.Equal(t, []FileDiff{
+		{Path: "added.txt", NewSize: 20, SizeDelta: 20},
+		{Path: "empty2.txt", SizeDelta: 0},
+	}, diff.Added)
+	require.Equal(t, []FileDiff{
+		{Path: "empty.txt", SizeDelta: 0},
+		{Path: "removed.txt", OldSize: 20, SizeDelta: -20},
+	}, diff.Removed)
+	require.Equal(t, []FileDiff{
+		{Path: "modified.txt", OldSize: 10, NewSize: 15, SizeDelta: 5},
+	}, diff.Modified)
+	require.Equal(t, []FileRename{
+		{OldPath: "old/moved.txt", NewPath: "new/moved.txt", Size: 20},
+	}, diff.Renamed)
+	require.Equal(t, int64(5), diff.SizeDelta)
+
+	empty := DiffSnapshots(a, a)
+	require.Empty(t, empty.Added)
+	require.Empty(t, empty.Removed)
+	require.Empty(t, empty.Modified)
+	require.Empty(t, empty.Renamed)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package backup
+
+import "io/fs"
+
+type fileInode struct{}
+
+// hardlinkInode reports no hardlinks, files are backed up once per path on this system.
+func hardlinkInode(fi fs.FileInfo) (fileInode, bool) {
+	return fileInode{}, false
+}
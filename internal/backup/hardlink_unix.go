@@ -0,0 +1,23 @@
+//go:build unix
+
+package backup
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileInode identifies a file independent of its paths.
+type fileInode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkInode returns the inode of a file with more than one link.
+func hardlinkInode(fi fs.FileInfo) (fileInode, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink <= 1 {
+		return fileInode{}, false
+	}
+	return fileInode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
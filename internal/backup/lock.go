@@ -0,0 +1,282 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+const locksDir = ".locks"
+
+type LockMode string
+
+const (
+	// LockShared is held by operations that read the repository or only add data to it, like backups and restores.
+	LockShared LockMode = "shared"
+	// LockExclusive is held by operations that remove data, like forget and prune.
+	LockExclusive LockMode = "exclusive"
+	// lockIndex serializes the read-modify-write of the blob index by concurrent backups.
+	lockIndex LockMode = "index"
+)
+
+var (
+	// lockRefreshInterval is the time between two refreshes of a held lock.
+	lockRefreshInterval = 5 * time.Minute
+	// lockStaleTimeout is the time after which a lock that has not been refreshed is considered stale.
+	lockStaleTimeout = 30 * time.Minute
+	// lockIndexTimeout limits the time to wait for the blob index lock.
+	lockIndexTimeout = 5 * time.Minute
+)
+
+// LockInfo is stored in a lock file below .locks in the destination.
+type LockInfo struct {
+	// Name is the file name of the lock.
+	Name        string `json:"-"`
+	Host        string
+	PID         int
+	Operation   string
+	Mode        LockMode
+	CreatedAt   time.Time
+	RefreshedAt time.Time
+}
+
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s lock of %q by PID %d on %s since %s", info.Mode, info.Operation, info.PID, info.Host, info.CreatedAt.Format(time.RFC3339))
+}
+
+// IsStale reports whether the process holding the lock is gone. This is known for locks of the local host, locks of other hosts are stale if they have not been refreshed for a while.
+func (info *LockInfo) IsStale() bool {
+	if time.Since(info.RefreshedAt) > lockStaleTimeout {
+		return true
+	}
+	if host, err := os.Hostname(); err == nil && host == info.Host {
+		return !processExists(info.PID)
+	}
+	return false
+}
+
+func (info *LockInfo) conflictsWith(mode LockMode) bool {
+	switch {
+	case info.Mode == LockExclusive || mode == LockExclusive:
+		return true
+	case info.Mode == lockIndex && mode == lockIndex:
+		return true
+	default:
+		return false
+	}
+}
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		// FindProcess already fails for unknown processes
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// LockedError is returned if a lock conflicts with a lock of another process.
+type LockedError struct {
+	Lock *LockInfo
+}
+
+func (err *LockedError) Error() string {
+	return fmt.Sprintf("repository is locked: %s (run 'keepr unlock' if the process is gone)", err.Lock)
+}
+
+// repositoryLock is held until Unlock is called. The lock file is refreshed in the background, so other processes do not consider it stale.
+type repositoryLock struct {
+	dest destination.Interface
+	info LockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockRepository creates a lock file and fails if a conflicting lock of another process exists. Stale locks are ignored.
+func lockRepository(dest destination.Interface, mode LockMode, operation string) (*repositoryLock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("get hostname: %w", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	l := &repositoryLock{
+		dest: dest,
+		info: LockInfo{
+			Name:        hex.EncodeToString(id),
+			Host:        host,
+			PID:         os.Getpid(),
+			Operation:   operation,
+			Mode:        mode,
+			CreatedAt:   now,
+			RefreshedAt: now,
+		},
+	}
+	if err := l.write(); err != nil {
+		return nil, fmt.Errorf("write lock file: %w", err)
+	}
+
+	// the own lock is written first, so two processes that lock at the same time see each other
+	locks, err := listLocks(dest)
+	if err != nil {
+		l.remove()
+		return nil, fmt.Errorf("list locks: %w", err)
+	}
+	for _, other := range locks {
+		if other.Name == l.info.Name || !other.conflictsWith(mode) {
+			continue
+		}
+		if other.IsStale() {
+			fmt.Println("WARN: ignoring stale", other.String())
+			continue
+		}
+		l.remove()
+		return nil, &LockedError{Lock: other}
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.refresh()
+	return l, nil
+}
+
+// lockBlobIndex waits until no other process updates the blob index.
+func lockBlobIndex(dest destination.Interface, operation string) (*repositoryLock, error) {
+	deadline := time.Now().Add(lockIndexTimeout)
+	for {
+		l, err := lockRepository(dest, lockIndex, operation)
+		var lockedErr *LockedError
+		if !errors.As(err, &lockedErr) || time.Now().After(deadline) {
+			return l, err
+		}
+		// random wait, so processes that back off at the same time do not collide again
+		time.Sleep(100*time.Millisecond + mathrand.N(time.Second))
+	}
+}
+
+func (l *repositoryLock) path() string {
+	return locksDir + "/" + l.info.Name
+}
+
+func (l *repositoryLock) write() error {
+	data, err := json.Marshal(&l.info)
+	if err != nil {
+		return err
+	}
+	return l.dest.WriteFile(l.path(), data)
+}
+
+func (l *repositoryLock) remove() error {
+	return l.dest.DeleteFile(l.path())
+}
+
+func (l *repositoryLock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.info.RefreshedAt = time.Now()
+			if err := l.write(); err != nil {
+				fmt.Println("WARN: cannot refresh lock:", err)
+			}
+		}
+	}
+}
+
+// Unlock stops refreshing and removes the lock file.
+func (l *repositoryLock) Unlock() error {
+	close(l.stop)
+	<-l.done
+	if err := l.remove(); err != nil && !l.dest.IsNotExists(err) {
+		return fmt.Errorf("remove lock file: %w", err)
+	}
+	return nil
+}
+
+// listLocks reads all lock files of dest. Lock files that disappear while reading them are skipped.
+func listLocks(dest destination.Interface) ([]*LockInfo, error) {
+	files, err := dest.ReadDir(locksDir)
+	if err != nil {
+		if dest.IsNotExists(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	locks := make([]*LockInfo, 0, len(files))
+	for _, fi := range files {
+		if fi.IsDir || destination.IsTempFile(fi.Name) {
+			continue
+		}
+		data, err := dest.ReadFile(locksDir + "/" + fi.Name)
+		if err != nil {
+			if dest.IsNotExists(err) {
+				continue
+			}
+			return nil, err
+		}
+		info := &LockInfo{Name: fi.Name}
+		if err := json.Unmarshal(data, info); err != nil {
+			// a lock that is currently written is not complete yet
+			fmt.Println("WARN: ignoring invalid lock file", fi.Name+":", err)
+			continue
+		}
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+// Unlock removes stale locks from all destinations of the backup set, or all locks if removeAll is set. The removed locks are returned.
+func (backupSet *BackupSet) Unlock(removeAll bool) ([]*LockInfo, error) {
+	if len(backupSet.conf.Destinations) == 0 {
+		return nil, fmt.Errorf("missing destination")
+	}
+
+	dests, openErrs := backupSet.OpenDestinations()
+	defer closeDestinations(dests)
+	var removed []*LockInfo
+	var errs []error
+	for i, dest := range dests {
+		name := backupSet.conf.Destinations[i].String()
+		if openErrs[i] != nil {
+			errs = append(errs, fmt.Errorf("init destination %s: %w", name, openErrs[i]))
+			continue
+		}
+		locks, err := listLocks(dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: list locks: %w", name, err))
+			continue
+		}
+		for _, lock := range locks {
+			if !removeAll && !lock.IsStale() {
+				continue
+			}
+			if err := dest.DeleteFile(locksDir + "/" + lock.Name); err != nil && !dest.IsNotExists(err) {
+				errs = append(errs, fmt.Errorf("destination %s: remove lock %s: %w", name, lock.Name, err))
+				continue
+			}
+			removed = append(removed, lock)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
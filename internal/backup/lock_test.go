@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestLock(t *testing.T, dest destination.Interface, info LockInfo) {
+	data := must(json.Marshal(&info))
+	require.NoError(t, dest.WriteFile(locksDir+"/"+info.Name, data))
+}
+
+func TestLockRepository(t *testing.T) {
+	t.Run("Conflicts", func(t *testing.T) {
+		dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+		shared1 := must(lockRepository(dest, LockShared, "backup"))
+		shared2 := must(lockRepository(dest, LockShared, "read"))
+
+		_, err := lockRepository(dest, LockExclusive, "prune")
+		var lockedErr *LockedError
+		require.ErrorAs(t, err, &lockedErr)
+		require.Equal(t, LockShared, lockedErr.Lock.Mode)
+		// the failed lock does not remain
+		require.Len(t, must(listLocks(dest)), 2)
+
+		require.NoError(t, shared1.Unlock())
+		require.NoError(t, shared2.Unlock())
+		exclusive := must(lockRepository(dest, LockExclusive, "prune"))
+		_, err = lockRepository(dest, LockShared, "backup")
+		require.ErrorAs(t, err, &lockedErr)
+		require.Equal(t, "prune", lockedErr.Lock.Operation)
+		require.NoError(t, exclusive.Unlock())
+		require.Empty(t, must(listLocks(dest)))
+	})
+
+	t.Run("Index", func(t *testing.T) {
+		dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+		shared := must(lockRepository(dest, LockShared, "backup"))
+		defer shared.Unlock()
+		index := must(lockRepository(dest, lockIndex, "backup"))
+		_, err := lockRepository(dest, lockIndex, "backup")
+		require.ErrorAs(t, err, new(*LockedError))
+
+		defer func(timeout time.Duration) { lockIndexTimeout = timeout }(lockIndexTimeout)
+		lockIndexTimeout = 0
+		_, err = lockBlobIndex(dest, "backup")
+		require.ErrorAs(t, err, new(*LockedError))
+		require.NoError(t, index.Unlock())
+		require.NoError(t, must(lockBlobIndex(dest, "backup")).Unlock())
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+		host := must(os.Hostname())
+		old := time.Now().Add(-2 * lockStaleTimeout)
+		// not refreshed by a process on another host
+		writeTestLock(t, dest, LockInfo{Name: "remote", Host: "elsewhere", PID: 1, Operation: "backup", Mode: LockShared, CreatedAt: old, RefreshedAt: old})
+		// the process on this host is gone
+		writeTestLock(t, dest, LockInfo{Name: "crashed", Host: host, PID: 1 << 30, Operation: "backup", Mode: LockShared, CreatedAt: time.Now(), RefreshedAt: time.Now()})
+
+		exclusive := must(lockRepository(dest, LockExclusive, "prune"))
+		require.NoError(t, exclusive.Unlock())
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		defer func(interval time.Duration) { lockRefreshInterval = interval }(lockRefreshInterval)
+		lockRefreshInterval = 10 * time.Millisecond
+		dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+		l := must(lockRepository(dest, LockShared, "backup"))
+		defer l.Unlock()
+		require.Eventually(t, func() bool {
+			locks := must(listLocks(dest))
+			return len(locks) == 1 && locks[0].RefreshedAt.After(locks[0].CreatedAt)
+		}, time.Second, 5*time.Millisecond)
+	})
+}
+
+func TestUnlock(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "a file", time.Now())
+	backupSet := newTestBackupSet(t, srcDir)
+	dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: backupSet.conf.Destinations[0].LocalFileSystem.Path}))
+	old := time.Now().Add(-2 * lockStaleTimeout)
+	writeTestLock(t, dest, LockInfo{Name: "stale", Host: "elsewhere", PID: 1, Operation: "backup", Mode: LockShared, CreatedAt: old, RefreshedAt: old})
+	active := must(lockRepository(dest, LockShared, "read"))
+	defer active.Unlock()
+
+	removed := must(backupSet.Unlock(false))
+	require.Len(t, removed, 1)
+	require.Equal(t, "stale", removed[0].Name)
+	require.Len(t, must(listLocks(dest)), 1)
+
+	// backups share the repository with the active lock
+	snapshot := takeTestSnapshot(t, backupSet)
+	err := backupSet.ForgetSnapshots([]*Snapshot{snapshot})
+	require.ErrorAs(t, err, new(*LockedError))
+
+	removed = must(backupSet.Unlock(true))
+	require.Len(t, removed, 1)
+	require.Empty(t, must(listLocks(dest)))
+}
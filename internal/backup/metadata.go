@@ -0,0 +1,281 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+// SnapshotOptions are stored in the metadata of a new snapshot.
+type SnapshotOptions struct {
+	Tags        []string
+	Description string
+}
+
+// SnapshotMetadata describes where and why a snapshot was taken.
+type SnapshotMetadata struct {
+	Hostname   string
+	Username   string
+	SourcePath string
+	BackupSet  string
+	// Version is the keepr version that took the snapshot.
+	Version string
+	// Tags are sorted and unique.
+	Tags        []string
+	Description string
+	// Parent is the name of the snapshot that unchanged files were taken from. It is empty for the first snapshot.
+	Parent string
+}
+
+// newSnapshotMetadata collects the metadata of a snapshot of backupSet taken by the current process.
+func newSnapshotMetadata(backupSet *BackupSet, opts SnapshotOptions) (SnapshotMetadata, error) {
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return SnapshotMetadata{}, err
+	}
+	if strings.ContainsRune(opts.Description, 0) {
+		return SnapshotMetadata{}, fmt.Errorf("description must not contain NUL characters")
+	}
+
+	meta := SnapshotMetadata{
+		SourcePath:  backupSet.conf.Source.Path,
+		BackupSet:   backupSet.conf.Name,
+		Version:     keeprVersion(),
+		Tags:        tags,
+		Description: opts.Description,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		meta.Hostname = hostname
+	}
+	if u, err := user.Current(); err == nil {
+		meta.Username = u.Username
+	}
+	return meta, nil
+}
+
+func keeprVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || len(info.Main.Version) == 0 {
+		return "unknown"
+	}
+	return info.Main.Version
+}
+
+// normalizeTags trims, sorts and deduplicates tags. Tags must not be empty or contain commas, because they are given as comma-separated lists on the command line.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 || strings.ContainsAny(tag, ",\x00") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// HasTag reports whether the snapshot is tagged with tag.
+func (snapshot *Snapshot) HasTag(tag string) bool {
+	_, found := slices.BinarySearch(snapshot.Tags, tag)
+	return found
+}
+
+// SnapshotFilter selects snapshots by their metadata. Empty fields match all snapshots.
+type SnapshotFilter struct {
+	Hostname string
+	Username string
+	// SourcePath matches the source path of the snapshot or a parent directory of it.
+	SourcePath string
+	// Tags must all be present on a snapshot.
+	Tags []string
+}
+
+func (filter SnapshotFilter) Matches(snapshot *Snapshot) bool {
+	if len(filter.Hostname) > 0 && filter.Hostname != snapshot.Hostname {
+		return false
+	}
+	if len(filter.Username) > 0 && filter.Username != snapshot.Username {
+		return false
+	}
+	if len(filter.SourcePath) > 0 {
+		prefix := strings.TrimRight(filter.SourcePath, "/\\")
+		if snapshot.SourcePath != prefix && !strings.HasPrefix(snapshot.SourcePath, prefix+"/") && !strings.HasPrefix(snapshot.SourcePath, prefix+"\\") {
+			return false
+		}
+	}
+	for _, tag := range filter.Tags {
+		if !snapshot.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterSnapshots returns the snapshots that match filter in their original order.
+func FilterSnapshots(snapshots []*Snapshot, filter SnapshotFilter) []*Snapshot {
+	filtered := make([]*Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if filter.Matches(snapshot) {
+			filtered = append(filtered, snapshot)
+		}
+	}
+	return filtered
+}
+
+// TagSnapshot adds and removes tags of an existing snapshot. Tags are stored next to the snapshot index, so the ID of the snapshot does not change. Only destinations that contain the snapshot are changed. Nothing is changed if any destination is unreachable.
+func (backupSet *BackupSet) TagSnapshot(snapshot *Snapshot, add, remove []string) error {
+	if len(snapshot.Name) == 0 {
+		return fmt.Errorf("snapshot from %v has no name", snapshot.CreatedAt)
+	}
+	add, err := normalizeTags(add)
+	if err != nil {
+		return err
+	}
+	remove, err = normalizeTags(remove)
+	if err != nil {
+		return err
+	}
+
+	tags := slices.DeleteFunc(append(slices.Clone(snapshot.Tags), add...), func(tag string) bool {
+		return slices.Contains(remove, tag)
+	})
+	tagged := *snapshot
+	if tagged.Tags, err = normalizeTags(tags); err != nil {
+		return err
+	}
+	if slices.Equal(tagged.Tags, snapshot.Tags) {
+		return nil
+	}
+
+	dests, err := backupSet.openAllDestinations()
+	if err != nil {
+		return err
+	}
+	defer closeDestinations(dests)
+	var found bool
+	var errs []error
+	for i, dest := range dests {
+		name := backupSet.conf.Destinations[i].String()
+		ok, err := tagged.retag(dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", name, err))
+			continue
+		}
+		found = found || ok
+	}
+	if found {
+		snapshot.Tags = tagged.Tags
+	} else if len(errs) == 0 {
+		return fmt.Errorf("snapshot %s not found", snapshot.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// retag replaces the tags of the snapshot on dest. It returns false if dest does not contain the snapshot.
+func (snapshot *Snapshot) retag(dest destination.Interface) (bool, error) {
+	// forget must not remove the snapshot while its tags are written
+	lock, err := lockRepository(dest, LockShared, "tag")
+	if err != nil {
+		return false, fmt.Errorf("lock repository: %w", err)
+	}
+	defer lock.Unlock()
+
+	if exists, err := dest.FileExists(snapshot.Name + "/.snapshot"); err != nil || !exists {
+		return false, err
+	}
+	if err := snapshot.writeTags(dest); err != nil {
+		return false, fmt.Errorf("write tags: %w", err)
+	}
+	return true, nil
+}
+
+/*
+Tags file format:
+
+	version (1 byte) | tag count (uint32) | tags
+
+The tags of a snapshot are stored in the file .tags next to its index, so they can be changed without changing the snapshot ID. Older snapshots store their tags in the index, a tags file replaces them.
+*/
+
+const (
+	snapshotTagsFile = ".tags"
+	snapshotTagsV0   = 0
+)
+
+func (snapshot *Snapshot) writeTags(dest destination.Interface) error {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := w.WriteByte(snapshotTagsV0); err != nil {
+		return err
+	}
+	if err := writeTags(w, snapshot.Tags); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return dest.WriteFile(snapshot.Name+"/"+snapshotTagsFile, buf.Bytes())
+}
+
+// readTags replaces the tags of the snapshot by those of its tags file, if there is one.
+func (snapshot *Snapshot) readTags(dest destination.Interface) error {
+	data, err := dest.ReadFile(snapshot.Name + "/" + snapshotTagsFile)
+	if err != nil {
+		if dest.IsNotExists(err) {
+			return nil
+		}
+		return err
+	}
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != snapshotTagsV0 {
+		return fmt.Errorf("unsupported tags version %d", version)
+	}
+	tags, err := readTags(r)
+	if err != nil {
+		return err
+	}
+	snapshot.Tags = tags
+	return nil
+}
+
+func writeTags(w *bufio.Writer, tags []string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(tags))); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := writeStr(w, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTags(r *bytes.Reader) ([]string, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for range count {
+		tag, err := readStr(r)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
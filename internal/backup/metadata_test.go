@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotMetadata(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+	backupSet := newTestBackupSet(t, srcDir)
+
+	snapshotter := must(NewSnapshotter(backupSet, SnapshotOptions{Tags: []string{"nightly", " manual", "nightly"}, Description: "before upgrade"}))
+	require.NoError(t, snapshotter.TakeSnapshot())
+	first := must(backupSet.FindSnapshot("latest"))
+	require.Equal(t, must(os.Hostname()), first.Hostname)
+	require.NotEmpty(t, first.Username)
+	require.Equal(t, srcDir, first.SourcePath)
+	require.Equal(t, "Test", first.BackupSet)
+	require.NotEmpty(t, first.Version)
+	require.Equal(t, []string{"manual", "nightly"}, first.Tags)
+	require.Equal(t, "before upgrade", first.Description)
+	require.Empty(t, first.Parent)
+
+	// snapshot names have a precision of seconds
+	time.Sleep(time.Until(first.CreatedAt.Truncate(time.Second).Add(time.Second)))
+	second := takeTestSnapshot(t, backupSet)
+	require.Equal(t, first.Name, second.Parent)
+	require.Empty(t, second.Tags)
+
+	t.Run("Tag", func(t *testing.T) {
+		require.NoError(t, backupSet.TagSnapshot(first, []string{"keep"}, []string{"nightly"}))
+		require.Equal(t, []string{"keep", "manual"}, first.Tags)
+		// tags are not part of the ID, so the parent reference of the second snapshot stays valid
+		require.Equal(t, second.Parent, first.Name)
+		tagged := must(backupSet.FindSnapshot(first.Name))
+		require.Equal(t, []string{"keep", "manual"}, tagged.Tags)
+		require.Equal(t, first.Tree, tagged.Tree)
+		require.Equal(t, "before upgrade", tagged.Description)
+
+		require.NoError(t, backupSet.TagSnapshot(tagged, nil, []string{"keep", "manual"}))
+		require.Empty(t, must(backupSet.FindSnapshot(first.Name)).Tags)
+		require.NoError(t, backupSet.TagSnapshot(tagged, []string{"keep", "manual"}, nil))
+
+		require.ErrorContains(t, backupSet.TagSnapshot(first, []string{"a,b"}, nil), "invalid tag")
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		snapshots := must(backupSet.ListSnapshots())
+		require.Len(t, FilterSnapshots(snapshots, SnapshotFilter{}), 2)
+		require.Len(t, FilterSnapshots(snapshots, SnapshotFilter{Hostname: must(os.Hostname()), SourcePath: srcDir}), 2)
+		require.Empty(t, FilterSnapshots(snapshots, SnapshotFilter{Hostname: "elsewhere"}))
+		require.Empty(t, FilterSnapshots(snapshots, SnapshotFilter{SourcePath: srcDir + "-other"}))
+
+		filtered := FilterSnapshots(snapshots, SnapshotFilter{Tags: []string{"keep", "manual"}})
+		require.Len(t, filtered, 1)
+		require.Equal(t, first.Name, filtered[0].Name)
+		require.Empty(t, FilterSnapshots(snapshots, SnapshotFilter{Tags: []string{"keep", "nightly"}}))
+	})
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleDestinations(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "a.txt", "first file", modTime)
+	writeTestFile(t, srcDir, "sub/b.txt", "second file", modTime)
+
+	firstDir, secondDir := t.TempDir(), t.TempDir()
+	backupSet := must(NewBackupSetFromConfig(BackupSetConfig{
+		Name:   "Test",
+		Source: BackupSourceLocalDirConfig{Path: srcDir},
+		Destinations: []destination.Config{
+			{LocalFileSystem: destination.LocalDirConfig{Path: firstDir}},
+			{LocalFileSystem: destination.LocalDirConfig{Path: secondDir}},
+		},
+	}))
+	snapshot := takeTestSnapshot(t, backupSet)
+
+	blobPath := snapshot.GetBlobPath(snapshot.Files["a.txt"].Blobs[0])
+	for _, dir := range []string{firstDir, secondDir} {
+		require.FileExists(t, filepath.Join(dir, snapshot.Name, ".snapshot"))
+		require.FileExists(t, filepath.Join(dir, chunkerParamsPath))
+		require.FileExists(t, filepath.Join(dir, blobPath))
+	}
+	require.Equal(t, must(os.ReadFile(filepath.Join(firstDir, chunkerParamsPath))), must(os.ReadFile(filepath.Join(secondDir, chunkerParamsPath))))
+
+	// restore falls back to the second destination
+	require.NoError(t, os.Remove(filepath.Join(firstDir, blobPath)))
+	targetDir := t.TempDir()
+	browser := must(NewBrowser(backupSet, snapshot))
+	require.NoError(t, browser.Restore(targetDir, RestoreOptions{}))
+	require.NoError(t, browser.Close())
+	requireTestFile(t, targetDir, "a.txt", "first file", modTime)
+
+	// unchanged files are uploaded again to destinations that miss their blobs
+	require.NoError(t, os.RemoveAll(firstDir))
+	takeTestSnapshot(t, backupSet)
+	require.FileExists(t, filepath.Join(firstDir, blobPath))
+	require.FileExists(t, filepath.Join(firstDir, chunkerParamsPath))
+
+	// only destinations that contain the snapshot are tagged
+	require.NoError(t, backupSet.TagSnapshot(snapshot, []string{"keep"}, nil))
+	require.FileExists(t, filepath.Join(secondDir, snapshot.Name, snapshotTagsFile))
+	require.NoDirExists(t, filepath.Join(firstDir, snapshot.Name))
+
+	reports := must(backupSet.Check(CheckOptions{ReadDataFraction: 1}))
+	require.Len(t, reports, 2)
+	for _, report := range reports {
+		require.Empty(t, report.Errors)
+		require.Equal(t, 4, report.ReferencedBlobs)
+	}
+}
+
+func TestMultipleDestinationsUnreachable(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+
+	destDir := t.TempDir()
+	backupSet := must(NewBackupSetFromConfig(BackupSetConfig{
+		Name:   "Test",
+		Source: BackupSourceLocalDirConfig{Path: srcDir},
+		Destinations: []destination.Config{
+			{SFTP: &destination.SFTPConfig{Host: "127.0.0.1", Port: 1, User: "keepr", Password: "secret", KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts")}},
+			{LocalFileSystem: destination.LocalDirConfig{Path: destDir}},
+		},
+	}))
+
+	err := must(NewSnapshotter(backupSet, SnapshotOptions{})).TakeSnapshot()
+	require.ErrorContains(t, err, "destination 1")
+	snapshot := must(backupSet.FindSnapshot("latest"))
+	require.FileExists(t, filepath.Join(destDir, snapshot.Name, ".snapshot"))
+
+	targetDir := t.TempDir()
+	require.NoError(t, must(NewBrowser(backupSet, snapshot)).Restore(targetDir, RestoreOptions{}))
+	require.Equal(t, []byte("first file"), must(os.ReadFile(filepath.Join(targetDir, "a.txt"))))
+
+	// modifying operations must not change only the reachable destinations
+	require.ErrorContains(t, backupSet.TagSnapshot(snapshot, []string{"keep"}, nil), "unreachable")
+	require.ErrorContains(t, backupSet.ForgetSnapshots([]*Snapshot{snapshot}), "unreachable")
+	_, err = backupSet.Prune(false)
+	require.ErrorContains(t, err, "unreachable")
+	require.FileExists(t, filepath.Join(destDir, snapshot.Name, ".snapshot"))
+	require.NoFileExists(t, filepath.Join(destDir, snapshot.Name, snapshotTagsFile))
+}
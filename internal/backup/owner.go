@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// fileOwnerLookup resolves the names of users and groups. Names are cached, because most files of a backup have the same owner.
+type fileOwnerLookup struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newFileOwnerLookup() *fileOwnerLookup {
+	return &fileOwnerLookup{users: make(map[uint32]string), groups: make(map[uint32]string)}
+}
+
+// Get returns the owner of a file, or nil if the system does not support file owners. Names of unknown ids are left empty.
+func (l *fileOwnerLookup) Get(fi fs.FileInfo) *FileOwner {
+	uid, gid, ok := fileOwnerIDs(fi)
+	if !ok {
+		return nil
+	}
+	userName, ok := l.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			userName = u.Username
+		}
+		l.users[uid] = userName
+	}
+	groupName, ok := l.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			groupName = g.Name
+		}
+		l.groups[gid] = groupName
+	}
+	return &FileOwner{UID: uid, GID: gid, User: userName, Group: groupName}
+}
+
+// restoreOwner changes the owner of path without following symlinks. Users and groups are mapped by name if they exist on this system, otherwise the numeric ids are used. Only root can change owners, so nothing is done for other users.
+func restoreOwner(path string, owner *FileOwner) error {
+	if owner == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid := int(owner.UID), int(owner.GID)
+	if len(owner.User) > 0 {
+		if u, err := user.Lookup(owner.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+	if len(owner.Group) > 0 {
+		if g, err := user.LookupGroup(owner.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+	return os.Lchown(path, uid, gid)
+}
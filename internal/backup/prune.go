@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+type PruneResult struct {
+	// Destination describes the pruned destination.
+	Destination       string
+	ReferencedBlobs   int
+	UnreferencedBlobs int
+	// ReclaimableBytes is the total stored size of all unreferenced blobs.
+	ReclaimableBytes uint64
+	// UnindexedBlobs counts unreferenced blob files without a blob index entry.
+	UnindexedBlobs int
+	RemovedDirs    int
+	// RemovedTempFiles counts leftovers of interrupted writes.
+	RemovedTempFiles int
+	// RemovedIncompleteSnapshots counts snapshot directories without index that were left by interrupted backups.
+	RemovedIncompleteSnapshots int
+}
+
+// Prune removes all blobs that are not referenced by any snapshot from every destination. Each destination is pruned based on its own snapshots, so destinations that missed a forget keep the blobs of their remaining snapshots. Nothing is pruned if any destination is unreachable.
+func (backupSet *BackupSet) Prune(dryRun bool) ([]*PruneResult, error) {
+	dests, err := backupSet.openAllDestinations()
+	if err != nil {
+		return nil, err
+	}
+	defer closeDestinations(dests)
+	results := make([]*PruneResult, 0, len(dests))
+	var errs []error
+	for i, dest := range dests {
+		name := backupSet.conf.Destinations[i].String()
+		result, err := backupSet.pruneDestination(dest, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", name, err))
+			continue
+		}
+		result.Destination = name
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+// pruneDestination rewrites the blob index before any blob is deleted, so an interrupted prune only leaves orphaned blob files behind. Nothing is changed if dryRun is set.
+func (backupSet *BackupSet) pruneDestination(dest destination.Interface, dryRun bool) (*PruneResult, error) {
+	lock, err := lockRepository(dest, LockExclusive, "prune")
+	if err != nil {
+		return nil, fmt.Errorf("lock repository: %w", err)
+	}
+	defer lock.Unlock()
+
+	snapshots, err := ListSnapshots(&snapshotContext{dest: dest})
+	if err != nil {
+		return nil, fmt.Errorf("list snapshots: %w", err)
+	}
+	// trees are encrypted like all other blobs
+	key, err := backupSet.openRepositoryKey(dest, false)
+	if err != nil {
+		return nil, fmt.Errorf("open repository key: %w", err)
+	}
+	referencedBlobIDs := make(map[BlobID]struct{})
+	addReferencedBlobs := func(files []FileSnapshot) {
+		for _, f := range files {
+			for _, blobID := range f.ReferencedBlobs() {
+				referencedBlobIDs[blobID] = struct{}{}
+			}
+		}
+	}
+	walker := newTreeWalker(dest, key)
+	for _, snapshot := range snapshots {
+		if snapshot.Tree == nil {
+			addReferencedBlobs(slices.Collect(maps.Values(snapshot.Files)))
+			continue
+		}
+		// a tree that cannot be read would leave its blobs unreferenced
+		_, err := walker.walk(*snapshot.Tree, func(id BlobID, entries []FileSnapshot) {
+			referencedBlobIDs[id] = struct{}{}
+			addReferencedBlobs(entries)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read trees of snapshot %s: %w", snapshot.Name, err)
+		}
+	}
+
+	blobIndex, err := backupSet.ReadBlobIndex(dest)
+	if err != nil {
+		return nil, fmt.Errorf("read blob index: %w", err)
+	}
+
+	result := &PruneResult{ReferencedBlobs: len(referencedBlobIDs)}
+
+	if !dryRun {
+		prunedIndex := make(map[BlobID]blobLen, len(referencedBlobIDs))
+		for id, blobLen := range blobIndex {
+			if _, ok := referencedBlobIDs[id]; ok {
+				prunedIndex[id] = blobLen
+			}
+		}
+		if err := backupSet.WriteBlobIndex(dest, prunedIndex); err != nil {
+			return nil, fmt.Errorf("write blob index: %w", err)
+		}
+	}
+
+	p := &pruner{
+		dest:              dest,
+		dryRun:            dryRun,
+		blobIndex:         blobIndex,
+		referencedBlobIDs: referencedBlobIDs,
+		result:            result,
+	}
+	if _, err := p.pruneDir(".blobs", nil); err != nil {
+		return nil, err
+	}
+	if err := p.pruneTempFiles(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type pruner struct {
+	dest              destination.Interface
+	dryRun            bool
+	blobIndex         map[BlobID]blobLen
+	referencedBlobIDs map[BlobID]struct{}
+	result            *PruneResult
+}
+
+// pruneDir walks the fan-out directories below .blobs. idParts contains the blob id prefixes of all parent directories. It returns whether the directory is empty after pruning.
+func (p *pruner) pruneDir(relPath string, idParts []string) (bool, error) {
+	files, err := p.dest.ReadDir(relPath)
+	if err != nil {
+		if p.dest.IsNotExists(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("read dir %q: %w", relPath, err)
+	}
+
+	remaining := len(files)
+	for _, fi := range files {
+		childPath := relPath + "/" + fi.Name
+		if fi.IsDir {
+			if len(idParts) >= 4 {
+				continue
+			}
+			empty, err := p.pruneDir(childPath, append(idParts, fi.Name))
+			if err != nil {
+				return false, err
+			}
+			if empty {
+				if !p.dryRun {
+					if err := p.dest.DeleteDir(childPath); err != nil {
+						return false, fmt.Errorf("delete empty dir %q: %w", childPath, err)
+					}
+				}
+				p.result.RemovedDirs++
+				remaining--
+			}
+			continue
+		}
+
+		if destination.IsTempFile(fi.Name) {
+			if err := p.removeTempFile(childPath); err != nil {
+				return false, err
+			}
+			remaining--
+			continue
+		}
+		if len(idParts) != 4 {
+			continue
+		}
+		blobID, err := ParseBlobID(strings.Join(idParts, "") + fi.Name)
+		if err != nil {
+			fmt.Println("WARN: ignoring unknown file", childPath)
+			continue
+		}
+		if _, ok := p.referencedBlobIDs[blobID]; ok {
+			continue
+		}
+
+		p.result.UnreferencedBlobs++
+		p.result.ReclaimableBytes += uint64(fi.Size)
+		if _, ok := p.blobIndex[blobID]; !ok {
+			p.result.UnindexedBlobs++
+		}
+		if !p.dryRun {
+			if err := p.dest.DeleteFile(childPath); err != nil {
+				return false, fmt.Errorf("delete blob %s: %w", blobID, err)
+			}
+		}
+		remaining--
+	}
+	return remaining == 0, nil
+}
+
+// pruneTempFiles removes leftovers of interrupted writes of the blob index and snapshot indexes, and snapshot directories of interrupted backups, which have no index because it is written last.
+func (p *pruner) pruneTempFiles() error {
+	files, err := p.dest.ReadDir("")
+	if err != nil {
+		return fmt.Errorf("read root dir: %w", err)
+	}
+	for _, fi := range files {
+		if !fi.IsDir {
+			if destination.IsTempFile(fi.Name) {
+				if err := p.removeTempFile(fi.Name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !isSnapshotDirName(fi.Name) {
+			continue
+		}
+		snapshotFiles, err := p.dest.ReadDir(fi.Name)
+		if err != nil {
+			return fmt.Errorf("read dir %q: %w", fi.Name, err)
+		}
+		if !slices.ContainsFunc(snapshotFiles, func(sfi destination.FileInfo) bool { return sfi.Name == ".snapshot" && !sfi.IsDir }) {
+			p.result.RemovedIncompleteSnapshots++
+			if !p.dryRun {
+				if err := p.dest.DeleteDir(fi.Name); err != nil {
+					return fmt.Errorf("delete incomplete snapshot %q: %w", fi.Name, err)
+				}
+			}
+			continue
+		}
+		for _, sfi := range snapshotFiles {
+			if !sfi.IsDir && destination.IsTempFile(sfi.Name) {
+				if err := p.removeTempFile(fi.Name + "/" + sfi.Name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *pruner) removeTempFile(relPath string) error {
+	p.result.RemovedTempFiles++
+	if p.dryRun {
+		return nil
+	}
+	if err := p.dest.DeleteFile(relPath); err != nil {
+		return fmt.Errorf("delete temporary file %q: %w", relPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+	writeTestFile(t, srcDir, "sub/b.txt", "second file", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	dest := must(backupSet.OpenDestination())
+	destDir := backupSet.conf.Destinations[0].LocalFileSystem.Path
+
+	orphanContent := []byte("orphaned blob")
+	orphanID := BlobID(sha256.Sum256(orphanContent))
+	require.NoError(t, dest.WriteFile(snapshot.GetBlobPath(orphanID), orphanContent))
+	blobIndex := must(backupSet.ReadBlobIndex(dest))
+	blobIndex[orphanID] = blobLen(len(orphanContent))
+	require.NoError(t, backupSet.WriteBlobIndex(dest, blobIndex))
+
+	result := must(backupSet.Prune(true))[0]
+	require.Equal(t, &PruneResult{Destination: destDir, ReferencedBlobs: 4, UnreferencedBlobs: 1, ReclaimableBytes: uint64(len(orphanContent)), RemovedDirs: 4}, result)
+	require.True(t, must(dest.FileExists(snapshot.GetBlobPath(orphanID))))
+
+	result = must(backupSet.Prune(false))[0]
+	require.Equal(t, &PruneResult{Destination: destDir, ReferencedBlobs: 4, UnreferencedBlobs: 1, ReclaimableBytes: uint64(len(orphanContent)), RemovedDirs: 4}, result)
+	require.False(t, must(dest.FileExists(snapshot.GetBlobPath(orphanID))))
+	require.NoDirExists(t, filepath.Join(destDir, snapshot.GetBlobDir(orphanID)[:9]))
+	require.NotContains(t, must(backupSet.ReadBlobIndex(dest)), orphanID)
+
+	browser := must(NewBrowser(backupSet, snapshot))
+	require.NoError(t, browser.Restore(t.TempDir(), RestoreOptions{}))
+	require.NoError(t, browser.Close())
+
+	require.NoError(t, backupSet.ForgetSnapshots([]*Snapshot{snapshot}))
+	result = must(backupSet.Prune(false))[0]
+	require.Equal(t, 0, result.ReferencedBlobs)
+	require.Equal(t, 4, result.UnreferencedBlobs)
+	require.Empty(t, must(backupSet.ReadBlobIndex(dest)))
+	require.Empty(t, must(os.ReadDir(filepath.Join(destDir, ".blobs"))))
+}
+
+func TestPruneTempFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	destDir := backupSet.conf.Destinations[0].LocalFileSystem.Path
+
+	blobID := snapshot.Files["a.txt"].Blobs[0]
+	tempFiles := []string{
+		".blob-index.123456.keepr-tmp",
+		snapshot.Name + "/.snapshot.123456.keepr-tmp",
+		snapshot.GetBlobPath(blobID) + ".123456.keepr-tmp",
+	}
+	for _, tempFile := range tempFiles {
+		require.NoError(t, os.WriteFile(filepath.Join(destDir, tempFile), []byte("incomplete"), 0600))
+	}
+
+	result := must(backupSet.Prune(true))[0]
+	require.Equal(t, 3, result.RemovedTempFiles)
+	require.FileExists(t, filepath.Join(destDir, tempFiles[0]))
+
+	result = must(backupSet.Prune(false))[0]
+	require.Equal(t, 3, result.RemovedTempFiles)
+	require.Equal(t, 0, result.UnreferencedBlobs)
+	for _, tempFile := range tempFiles {
+		require.NoFileExists(t, filepath.Join(destDir, tempFile))
+	}
+
+	browser := must(NewBrowser(backupSet, snapshot))
+	require.NoError(t, browser.Restore(t.TempDir(), RestoreOptions{}))
+	require.NoError(t, browser.Close())
+}
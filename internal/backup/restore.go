@@ -0,0 +1,290 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type RestoreOptions struct {
+	// Path restricts the restore to a single file or directory of the snapshot. All files are restored if empty.
+	Path string
+	// Overwrite allows replacing existing files in the target directory.
+	Overwrite bool
+	// Xattrs restores extended attributes and POSIX ACLs.
+	Xattrs bool
+}
+
+// Restore writes all entries of the snapshot matching opts.Path to targetDir. Paths are restored relative to the snapshot root and blobs are verified against their BlobID. Modes, owners and modification times are restored as well, owners only when running as root. Hardlinks are recreated as links.
+func (browser *Browser) Restore(targetDir string, opts RestoreOptions) error {
+	files, err := browser.filesWithPrefix(opts.Path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("path %q not found in snapshot", opts.Path)
+	}
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("create target dir: %w", err)
+	}
+
+	restored := make(map[string]bool, len(files))
+	for _, file := range files {
+		restored[file.Path] = true
+	}
+
+	buf := make([]byte, blobSize)
+	var dirs, symlinks, hardlinks []FileSnapshot
+	for _, file := range files {
+		var err error
+		switch {
+		case file.IsDir():
+			err = browser.restoreDir(targetDir, file)
+			dirs = append(dirs, file)
+		case file.IsSymlink():
+			// symlinks are created after all files, so no file can be written through a symlink
+			symlinks = append(symlinks, file)
+		case len(file.HardlinkTarget) > 0 && restored[file.HardlinkTarget]:
+			hardlinks = append(hardlinks, file)
+		default:
+			// hardlinks to files outside of opts.Path are restored as copies
+			err = browser.restoreFile(targetDir, file, opts, buf)
+		}
+		if err != nil {
+			return fmt.Errorf("restore %q: %w", file.Path, err)
+		}
+	}
+	for _, file := range hardlinks {
+		if err := browser.restoreHardlink(targetDir, file, opts); err != nil {
+			return fmt.Errorf("restore %q: %w", file.Path, err)
+		}
+	}
+	for _, file := range symlinks {
+		if err := browser.restoreSymlink(targetDir, file, opts); err != nil {
+			return fmt.Errorf("restore %q: %w", file.Path, err)
+		}
+	}
+	// children first, so restoring their metadata does not change the modification time of the parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := browser.restoreMetadata(restorePath(targetDir, dirs[i]), dirs[i], opts); err != nil {
+			return fmt.Errorf("restore %q: %w", dirs[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// filesWithPrefix returns the entry at prefix and all entries below it sorted by path. Snapshots with a root tree only read the trees below prefix.
+func (browser *Browser) filesWithPrefix(prefix string) ([]FileSnapshot, error) {
+	prefix = strings.Trim(prefix, "/")
+	files := make([]FileSnapshot, 0)
+	if browser.snapshot.Tree == nil {
+		for _, f := range browser.snapshot.Files {
+			if len(prefix) == 0 || f.Path == prefix || strings.HasPrefix(f.Path, prefix+"/") {
+				files = append(files, f)
+			}
+		}
+	} else {
+		if len(prefix) > 0 {
+			f, ok, err := browser.lookup(prefix)
+			if err != nil || !ok {
+				return files, err
+			}
+			files = append(files, f)
+		}
+		var err error
+		if files, err = browser.appendFilesBelow(files, prefix); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// appendFilesBelow appends all entries below the directory at path to files.
+func (browser *Browser) appendFilesBelow(files []FileSnapshot, path string) ([]FileSnapshot, error) {
+	entries, err := browser.readDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range entries {
+		files = append(files, f)
+		if f.IsDir() {
+			if files, err = browser.appendFilesBelow(files, f.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// restorePath returns the path of file below targetDir, or an empty string if the path would leave targetDir.
+func restorePath(targetDir string, file FileSnapshot) string {
+	localRelPath := filepath.FromSlash(file.Path)
+	if !filepath.IsLocal(localRelPath) {
+		return ""
+	}
+	return filepath.Join(targetDir, localRelPath)
+}
+
+// restoreDir creates the directory with permissions for the owner, so files can be restored into read-only directories. Its metadata is restored after all files.
+func (browser *Browser) restoreDir(targetDir string, file FileSnapshot) error {
+	targetPath := restorePath(targetDir, file)
+	if len(targetPath) == 0 {
+		return fmt.Errorf("refusing to restore path outside of target dir")
+	}
+	if err := createDirs(targetDir, targetPath); err != nil {
+		return err
+	}
+	return os.Chmod(targetPath, 0700)
+}
+
+// createDirs creates dir and its missing parents below targetDir. Unlike os.MkdirAll it refuses to follow existing symlinks, which could point outside of targetDir.
+func createDirs(targetDir, dir string) error {
+	relPath, err := filepath.Rel(targetDir, dir)
+	if err != nil {
+		return err
+	}
+	if relPath == "." {
+		return nil
+	}
+	path := targetDir
+	for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+		path = filepath.Join(path, name)
+		fi, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to restore through symlink %q", path)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", path)
+		}
+	}
+	return nil
+}
+
+func (browser *Browser) restoreSymlink(targetDir string, file FileSnapshot, opts RestoreOptions) error {
+	targetPath := restorePath(targetDir, file)
+	if len(targetPath) == 0 {
+		return fmt.Errorf("refusing to restore path outside of target dir")
+	}
+	if err := createDirs(targetDir, filepath.Dir(targetPath)); err != nil {
+		return fmt.Errorf("create parent directory: %w", err)
+	}
+	if opts.Overwrite {
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(file.LinkTarget, targetPath); err != nil {
+		return err
+	}
+	if err := restoreOwner(targetPath, file.Owner); err != nil {
+		return err
+	}
+	if opts.Xattrs {
+		return browser.restoreXattrs(targetPath, file)
+	}
+	return nil
+}
+
+// removeExisting removes a file or symlink at path, so a link can be created instead. Directories are kept.
+func removeExisting(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.IsDir() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// restoreHardlink links the file to the already restored first file of its hardlink group. Both share the content and metadata.
+func (browser *Browser) restoreHardlink(targetDir string, file FileSnapshot, opts RestoreOptions) error {
+	targetPath := restorePath(targetDir, file)
+	linkedPath := restorePath(targetDir, FileSnapshot{Path: file.HardlinkTarget})
+	if len(targetPath) == 0 || len(linkedPath) == 0 {
+		return fmt.Errorf("refusing to restore path outside of target dir")
+	}
+	if err := createDirs(targetDir, filepath.Dir(targetPath)); err != nil {
+		return fmt.Errorf("create parent directory: %w", err)
+	}
+	if opts.Overwrite {
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+	}
+	return os.Link(linkedPath, targetPath)
+}
+
+func (browser *Browser) restoreFile(targetDir string, file FileSnapshot, opts RestoreOptions, buf []byte) error {
+	targetPath := restorePath(targetDir, file)
+	if len(targetPath) == 0 {
+		return fmt.Errorf("refusing to restore path outside of target dir")
+	}
+
+	if err := createDirs(targetDir, filepath.Dir(targetPath)); err != nil {
+		return fmt.Errorf("create parent directory: %w", err)
+	}
+
+	// existing files are replaced instead of truncated, so neither symlinks nor other hardlinks of them are written through
+	if opts.Overwrite {
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+	}
+	// the final mode is set after the content is written, so the file is never readable by others before
+	f, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := browser.openFile(file.Path, true)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := io.CopyBuffer(f, r, buf)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != file.Size {
+		return fmt.Errorf("restored %d bytes, but expected %d", n, file.Size)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return browser.restoreMetadata(targetPath, file, opts)
+}
+
+// restoreMetadata sets owner, extended attributes, mode and modification time of a restored file or directory. The owner is changed first, because chown clears the setuid and setgid bits and file capabilities. The mode is set after the attributes, so they can still be written to read-only files.
+func (browser *Browser) restoreMetadata(path string, file FileSnapshot, opts RestoreOptions) error {
+	if err := restoreOwner(path, file.Owner); err != nil {
+		return err
+	}
+	if opts.Xattrs {
+		if err := browser.restoreXattrs(path, file); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(path, file.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, file.LastModified, file.LastModified)
+}
@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestore(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "a.txt", "first file", modTime)
+	writeTestFile(t, srcDir, "sub/b.txt", "second file", modTime)
+	writeTestFile(t, srcDir, "sub/deeper/c.txt", "", modTime)
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	browser := must(NewBrowser(backupSet, snapshot))
+
+	t.Run("Full", func(t *testing.T) {
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{}))
+		requireTestFile(t, targetDir, "a.txt", "first file", modTime)
+		requireTestFile(t, targetDir, "sub/b.txt", "second file", modTime)
+		requireTestFile(t, targetDir, "sub/deeper/c.txt", "", modTime)
+	})
+
+	t.Run("Subtree", func(t *testing.T) {
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{Path: "sub/deeper"}))
+		requireTestFile(t, targetDir, "sub/deeper/c.txt", "", modTime)
+		require.NoFileExists(t, filepath.Join(targetDir, "a.txt"))
+		require.NoFileExists(t, filepath.Join(targetDir, "sub/b.txt"))
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		targetDir := t.TempDir()
+		writeTestFile(t, targetDir, "a.txt", "modified", time.Now())
+		require.Error(t, browser.Restore(targetDir, RestoreOptions{Path: "a.txt"}))
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{Path: "a.txt", Overwrite: true}))
+		requireTestFile(t, targetDir, "a.txt", "first file", modTime)
+	})
+
+	t.Run("ExistingSymlinks", func(t *testing.T) {
+		outsideDir := t.TempDir()
+		writeTestFile(t, outsideDir, "a.txt", "outside", modTime)
+		targetDir := t.TempDir()
+		require.NoError(t, os.Symlink(filepath.Join(outsideDir, "a.txt"), filepath.Join(targetDir, "a.txt")))
+		require.NoError(t, os.Symlink(outsideDir, filepath.Join(targetDir, "sub")))
+
+		// the symlink is replaced, not written through
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{Path: "a.txt", Overwrite: true}))
+		requireTestFile(t, targetDir, "a.txt", "first file", modTime)
+		require.ErrorContains(t, browser.Restore(targetDir, RestoreOptions{Path: "sub", Overwrite: true}), "symlink")
+		require.Equal(t, []byte("outside"), must(os.ReadFile(filepath.Join(outsideDir, "a.txt"))))
+		require.NoFileExists(t, filepath.Join(outsideDir, "b.txt"))
+		require.NoDirExists(t, filepath.Join(outsideDir, "deeper"))
+	})
+
+	t.Run("UnknownPath", func(t *testing.T) {
+		require.Error(t, browser.Restore(t.TempDir(), RestoreOptions{Path: "missing"}))
+	})
+
+	t.Run("CorruptedBlob", func(t *testing.T) {
+		file := snapshot.Files["sub/b.txt"]
+		blobPath := filepath.Join(backupSet.conf.Destinations[0].LocalFileSystem.Path, snapshot.GetBlobPath(file.Blobs[0]))
+		require.NoError(t, os.WriteFile(blobPath, []byte("tampered!!!"), 0644))
+		require.ErrorContains(t, browser.Restore(t.TempDir(), RestoreOptions{Path: "sub/b.txt"}), "corrupted")
+	})
+}
+
+func newTestBackupSet(t *testing.T, srcDir string) *BackupSet {
+	return must(NewBackupSetFromConfig(BackupSetConfig{
+		Name:   "Test",
+		Source: BackupSourceLocalDirConfig{Path: srcDir},
+		Destinations: []destination.Config{
+			{LocalFileSystem: destination.LocalDirConfig{Path: t.TempDir()}},
+		},
+	}))
+}
+
+func takeTestSnapshot(t *testing.T, backupSet *BackupSet) *Snapshot {
+	snapshotter := must(NewSnapshotter(backupSet, SnapshotOptions{}))
+	require.NoError(t, snapshotter.TakeSnapshot())
+	snapshot := must(backupSet.FindSnapshot("latest"))
+	require.NoError(t, backupSet.LoadSnapshotFiles(snapshot))
+	return snapshot
+}
+
+func writeTestFile(t *testing.T, dir, relPath, content string, modTime time.Time) {
+	path := filepath.Join(dir, filepath.FromSlash(relPath))
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 123456789, time.UTC)
+	writeTestFile(t, srcDir, "private/key.txt", "secret", modTime)
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "private/key.txt"), 0600))
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "private"), 0750))
+	require.NoError(t, os.Chtimes(filepath.Join(srcDir, "private"), modTime, modTime))
+	require.NoError(t, os.Mkdir(filepath.Join(srcDir, "empty"), 0755))
+	require.NoError(t, os.Symlink("private/key.txt", filepath.Join(srcDir, "link")))
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	require.True(t, snapshot.Files["empty"].IsDir())
+	require.Equal(t, "private/key.txt", snapshot.Files["link"].LinkTarget)
+	require.NotNil(t, snapshot.Files["private/key.txt"].Owner)
+
+	browser := must(NewBrowser(backupSet, snapshot))
+	defer browser.Close()
+	targetDir := t.TempDir()
+	require.NoError(t, browser.Restore(targetDir, RestoreOptions{}))
+
+	requireTestFile(t, targetDir, "private/key.txt", "secret", modTime)
+	require.Equal(t, os.FileMode(0600), must(os.Stat(filepath.Join(targetDir, "private/key.txt"))).Mode())
+	dirInfo := must(os.Stat(filepath.Join(targetDir, "private")))
+	require.Equal(t, os.ModeDir|0750, dirInfo.Mode())
+	require.True(t, modTime.Equal(dirInfo.ModTime()))
+	require.DirExists(t, filepath.Join(targetDir, "empty"))
+	require.Equal(t, "private/key.txt", must(os.Readlink(filepath.Join(targetDir, "link"))))
+
+	// symlinks are replaced on overwrite
+	require.NoError(t, browser.Restore(targetDir, RestoreOptions{Path: "link", Overwrite: true}))
+	require.Equal(t, "private/key.txt", must(os.Readlink(filepath.Join(targetDir, "link"))))
+}
+
+func TestRestoreHardlinks(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "a.txt", "linked file", modTime)
+	require.NoError(t, os.Mkdir(filepath.Join(srcDir, "sub"), 0755))
+	require.NoError(t, os.Link(filepath.Join(srcDir, "a.txt"), filepath.Join(srcDir, "b.txt")))
+	require.NoError(t, os.Link(filepath.Join(srcDir, "a.txt"), filepath.Join(srcDir, "sub/c.txt")))
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	require.Empty(t, snapshot.Files["a.txt"].HardlinkTarget)
+	for _, path := range []string{"b.txt", "sub/c.txt"} {
+		require.Equal(t, "a.txt", snapshot.Files[path].HardlinkTarget)
+		require.Equal(t, snapshot.Files["a.txt"].Blobs, snapshot.Files[path].Blobs)
+		require.Equal(t, uint64(len("linked file")), snapshot.Files[path].Size)
+	}
+
+	browser := must(NewBrowser(backupSet, snapshot))
+	defer browser.Close()
+
+	t.Run("Full", func(t *testing.T) {
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{}))
+		requireTestFile(t, targetDir, "sub/c.txt", "linked file", modTime)
+		a := must(os.Stat(filepath.Join(targetDir, "a.txt")))
+		require.True(t, os.SameFile(a, must(os.Stat(filepath.Join(targetDir, "b.txt")))))
+		require.True(t, os.SameFile(a, must(os.Stat(filepath.Join(targetDir, "sub/c.txt")))))
+	})
+
+	t.Run("Subtree", func(t *testing.T) {
+		// the first file of the group is not restored, so the link becomes a copy
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{Path: "sub"}))
+		requireTestFile(t, targetDir, "sub/c.txt", "linked file", modTime)
+	})
+}
+
+func requireTestFile(t *testing.T, dir, relPath, content string, modTime time.Time) {
+	path := filepath.Join(dir, filepath.FromSlash(relPath))
+	require.Equal(t, []byte(content), must(os.ReadFile(path)))
+	require.True(t, modTime.Equal(must(os.Stat(path)).ModTime()))
+}
+
+func must[T any](result T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+type RetentionPolicyConfig struct {
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// KeepWithin keeps all snapshots created within this duration before the latest snapshot, e.g. "36h", "14d" or "2w".
+	KeepWithin string
+}
+
+func (policy RetentionPolicyConfig) IsEmpty() bool {
+	return policy.KeepLast <= 0 && policy.KeepHourly <= 0 && policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 &&
+		policy.KeepMonthly <= 0 && policy.KeepYearly <= 0 && len(policy.KeepWithin) == 0
+}
+
+type RetentionDecision struct {
+	Snapshot *Snapshot
+	Keep     bool
+	// Reasons lists the rules that keep the snapshot.
+	Reasons []string
+}
+
+type retentionBucketRule struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+// ApplyRetentionPolicy decides which snapshots to keep. Decisions are returned newest first. Bucket rules keep the newest snapshot of each of the last n hours, days, weeks, months or years that contain a snapshot.
+func ApplyRetentionPolicy(snapshots []*Snapshot, policy RetentionPolicyConfig) ([]RetentionDecision, error) {
+	if policy.IsEmpty() {
+		return nil, fmt.Errorf("retention policy is empty")
+	}
+
+	var keepWithin time.Duration
+	if len(policy.KeepWithin) > 0 {
+		d, err := parseRetentionDuration(policy.KeepWithin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KeepWithin: %w", err)
+		}
+		keepWithin = d
+	}
+
+	sorted := make([]*Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+
+	rules := []*retentionBucketRule{
+		{name: "hourly", count: policy.KeepHourly, key: func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{name: "daily", count: policy.KeepDaily, key: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{name: "weekly", count: policy.KeepWeekly, key: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", year, week)
+		}},
+		{name: "monthly", count: policy.KeepMonthly, key: func(t time.Time) string { return t.Format("2006-01") }},
+		{name: "yearly", count: policy.KeepYearly, key: func(t time.Time) string { return t.Format("2006") }},
+	}
+	lastKeys := make([]string, len(rules))
+
+	decisions := make([]RetentionDecision, 0, len(sorted))
+	for i, snapshot := range sorted {
+		decision := RetentionDecision{Snapshot: snapshot}
+
+		if i < policy.KeepLast {
+			decision.Reasons = append(decision.Reasons, "last")
+		}
+		if keepWithin > 0 && !snapshot.CreatedAt.Before(sorted[0].CreatedAt.Add(-keepWithin)) {
+			decision.Reasons = append(decision.Reasons, "within "+policy.KeepWithin)
+		}
+
+		createdAt := snapshot.CreatedAt.Local()
+		for j, rule := range rules {
+			if rule.count <= 0 {
+				continue
+			}
+			key := rule.key(createdAt)
+			if key != lastKeys[j] {
+				lastKeys[j] = key
+				rule.count--
+				decision.Reasons = append(decision.Reasons, rule.name)
+			}
+		}
+
+		decision.Keep = len(decision.Reasons) > 0
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
+
+// parseRetentionDuration extends time.ParseDuration with the units d (days) and w (weeks). Negative durations are rejected, because they would keep nothing.
+func parseRetentionDuration(str string) (time.Duration, error) {
+	d, err := parseDurationWithDays(str)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", str)
+	}
+	return d, nil
+}
+
+func parseDurationWithDays(str string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if num, ok := strings.CutSuffix(str, suffix); ok {
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(str)
+}
+
+// ForgetSnapshots removes the given snapshot directories from all destinations. Blobs are not removed. Nothing is removed if any destination is unreachable.
+func (backupSet *BackupSet) ForgetSnapshots(snapshots []*Snapshot) error {
+	dests, err := backupSet.openAllDestinations()
+	if err != nil {
+		return err
+	}
+	defer closeDestinations(dests)
+	dest, err := destination.NewMirror(dests)
+	if err != nil {
+		return err
+	}
+	lock, err := lockRepository(dest, LockExclusive, "forget")
+	if err != nil {
+		return fmt.Errorf("lock repository: %w", err)
+	}
+	defer lock.Unlock()
+
+	for _, snapshot := range snapshots {
+		if len(snapshot.Name) == 0 {
+			return fmt.Errorf("snapshot from %v has no name", snapshot.CreatedAt)
+		}
+		if err := dest.DeleteDir(snapshot.Name); err != nil {
+			return fmt.Errorf("delete snapshot %s: %w", snapshot.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	newSnapshot := func(str string) *Snapshot {
+		createdAt := must(time.ParseInLocation(time.DateTime, str, time.Local))
+		return &Snapshot{Name: str, CreatedAt: createdAt}
+	}
+	snapshots := []*Snapshot{
+		newSnapshot("2024-01-31 23:00:00"),
+		newSnapshot("2024-02-28 10:00:00"),
+		newSnapshot("2024-03-01 08:00:00"),
+		newSnapshot("2024-03-01 20:00:00"),
+		newSnapshot("2024-03-02 08:00:00"),
+		newSnapshot("2024-03-02 09:00:00"),
+		newSnapshot("2024-03-02 09:30:00"),
+	}
+	kept := func(decisions []RetentionDecision) []string {
+		names := make([]string, 0)
+		for _, d := range decisions {
+			if d.Keep {
+				names = append(names, d.Snapshot.Name)
+			}
+		}
+		return names
+	}
+
+	_, err := ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{})
+	require.Error(t, err)
+
+	decisions := must(ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepLast: 2}))
+	require.Len(t, decisions, len(snapshots))
+	require.Equal(t, []string{"2024-03-02 09:30:00", "2024-03-02 09:00:00"}, kept(decisions))
+	require.Equal(t, []string{"last"}, decisions[0].Reasons)
+
+	decisions = must(ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepDaily: 3}))
+	require.Equal(t, []string{"2024-03-02 09:30:00", "2024-03-01 20:00:00", "2024-02-28 10:00:00"}, kept(decisions))
+
+	decisions = must(ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepHourly: 2, KeepMonthly: 3}))
+	require.Equal(t, []string{"2024-03-02 09:30:00", "2024-03-02 08:00:00", "2024-02-28 10:00:00", "2024-01-31 23:00:00"}, kept(decisions))
+	require.Equal(t, []string{"hourly", "monthly"}, decisions[0].Reasons)
+
+	decisions = must(ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepYearly: 1}))
+	require.Equal(t, []string{"2024-03-02 09:30:00"}, kept(decisions))
+
+	decisions = must(ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepWithin: "1d"}))
+	require.Equal(t, []string{"2024-03-02 09:30:00", "2024-03-02 09:00:00", "2024-03-02 08:00:00", "2024-03-01 20:00:00"}, kept(decisions))
+
+	_, err = ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepWithin: "soon"})
+	require.Error(t, err)
+	for _, keepWithin := range []string{"-7d", "-1w", "-3h"} {
+		_, err = ApplyRetentionPolicy(snapshots, RetentionPolicyConfig{KeepWithin: keepWithin})
+		require.ErrorContains(t, err, "negative")
+	}
+}
@@ -1,21 +1,28 @@
 package backup
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/sbreitf1/keepr/internal/backup/destination"
+	"github.com/sbreitf1/keepr/internal/ratelimit"
 )
 
 const (
+	// blobSize is the chunk size of repositories with fixed-size chunking.
 	blobSize = uint64(50 * 1024 * 1024)
 )
 
@@ -25,29 +32,120 @@ type Snapshotter interface {
 
 type snapshotter struct {
 	backupSet *BackupSet
+	opts      SnapshotOptions
+	// readLimiter limits reading source files, it is nil if reads are not limited.
+	readLimiter *ratelimit.Limiter
 }
 
 type snapshotContext struct {
-	relPath           string
+	// dest is used to read existing snapshots. It mirrors all targets during TakeSnapshot.
 	dest              destination.Interface
+	targets           []*snapshotTarget
+	encoder           *blobEncoder
+	chunkerParams     chunkerParams
+	gearTable         *gearTable
 	snapshot          *Snapshot
 	previousSnapshot  *Snapshot
-	existingBlobIDs   map[BlobID]blobLen
 	referencedBlobIDs map[BlobID]blobLen
-	uploadedBlobIDs   map[BlobID]blobLen
+}
+
+// snapshotTarget is a destination the snapshot is written to. A failed target is skipped for the rest of the snapshot.
+type snapshotTarget struct {
+	name            string
+	dest            destination.Interface
+	lock            *repositoryLock
+	existingBlobIDs map[BlobID]blobLen
+	uploadedBlobIDs map[BlobID]blobLen
+	err             error
+}
+
+func (ctx *snapshotContext) activeTargets() []*snapshotTarget {
+	targets := make([]*snapshotTarget, 0, len(ctx.targets))
+	for _, target := range ctx.targets {
+		if target.err == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+func (target *snapshotTarget) fail(err error) {
+	fmt.Println("ERR: destination", target.name, "failed:", err)
+	target.err = err
+}
+
+func (target *snapshotTarget) hasBlob(id BlobID) bool {
+	if _, ok := target.existingBlobIDs[id]; ok {
+		return true
+	}
+	_, ok := target.uploadedBlobIDs[id]
+	return ok
 }
 
 type Snapshot struct {
+	// Name is the directory name of the snapshot in the destination.
+	Name      string
 	CreatedAt time.Time
+	// Files is nil for snapshots with a root tree until it is loaded with BackupSet.LoadSnapshotFiles.
 	Files     map[string]FileSnapshot
 	TotalSize uint64
+	// FileCount is the number of entries, which is known before Files is loaded.
+	FileCount int
+	// Tree is the root tree of snapshots of index version 6 and later. Older snapshots store all entries in the index.
+	Tree *BlobID
+	// SnapshotMetadata is empty for snapshots of index versions before 4.
+	SnapshotMetadata
 }
 
+// FileSnapshot is an entry of a snapshot. Besides regular files, it can be a directory or a symlink, see Mode.
 type FileSnapshot struct {
 	Path         string
 	LastModified time.Time
 	Size         uint64
 	Blobs        []BlobID
+	// Mode contains the type and permission bits. Entries of version 0 indexes are regular files with mode 0644.
+	Mode fs.FileMode
+	// Owner is nil if it is unknown, like for entries of version 0 indexes.
+	Owner *FileOwner
+	// LinkTarget is the target of a symlink.
+	LinkTarget string
+	// Xattrs are sorted by name.
+	Xattrs []Xattr
+	// HardlinkTarget is the path of the first file of a hardlink group and is set for all other files of the group. Their Size and Blobs are taken from that file, because the index only stores them once.
+	HardlinkTarget string
+	// Tree is the tree object of a directory. It is nil for directories of snapshots without root tree.
+	Tree *BlobID
+}
+
+// ReferencedBlobs returns the blobs of the content and the extended attributes.
+func (file FileSnapshot) ReferencedBlobs() []BlobID {
+	blobs := file.Blobs
+	for _, xattr := range file.Xattrs {
+		if xattr.Blob != nil {
+			blobs = append(blobs[:len(blobs):len(blobs)], *xattr.Blob)
+		}
+	}
+	return blobs
+}
+
+func (file FileSnapshot) IsDir() bool {
+	return file.Mode.IsDir()
+}
+
+func (file FileSnapshot) IsRegular() bool {
+	return file.Mode.IsRegular()
+}
+
+func (file FileSnapshot) IsSymlink() bool {
+	return file.Mode&fs.ModeSymlink != 0
+}
+
+// FileOwner stores the names of user and group next to their ids, so restores on other systems can map them.
+type FileOwner struct {
+	UID   uint32
+	GID   uint32
+	User  string
+	Group string
 }
 
 type blob struct {
@@ -55,7 +153,7 @@ type blob struct {
 	Content []byte
 }
 
-func NewSnapshotter(backupSet *BackupSet) (Snapshotter, error) {
+func NewSnapshotter(backupSet *BackupSet, opts SnapshotOptions) (Snapshotter, error) {
 	if !filepath.IsAbs(backupSet.conf.Source.Path) {
 		return nil, fmt.Errorf("source path must be absolute")
 	}
@@ -64,45 +162,122 @@ func NewSnapshotter(backupSet *BackupSet) (Snapshotter, error) {
 	if len(backupSet.conf.Destinations) == 0 {
 		return nil, fmt.Errorf("missing destination")
 	}
-	if len(backupSet.conf.Destinations) > 1 {
-		return nil, fmt.Errorf("multiple destinations not yet supported")
+
+	if _, err := normalizeTags(opts.Tags); err != nil {
+		return nil, err
+	}
+
+	readLimiter, err := backupSet.conf.Source.RateLimit.newLimiter()
+	if err != nil {
+		return nil, fmt.Errorf("init source rate limit: %w", err)
 	}
 
 	return &snapshotter{
-		backupSet: backupSet,
+		backupSet:   backupSet,
+		opts:        opts,
+		readLimiter: readLimiter,
 	}, nil
 }
 
+// TakeSnapshot writes a new snapshot to all destinations of the backup set. Destinations that fail are skipped and reported in the returned error, the snapshot is only aborted if no destination is left.
 func (snapshotter *snapshotter) TakeSnapshot() error {
-	dest, err := snapshotter.backupSet.OpenDestination()
+	meta, err := newSnapshotMetadata(snapshotter.backupSet, snapshotter.opts)
 	if err != nil {
-		return fmt.Errorf("init destination: %w", err)
+		return err
 	}
-
 	snapshot := &Snapshot{
-		CreatedAt: time.Now(),
-	}
-
-	existingBlobs, err := snapshotter.backupSet.ReadBlobIndex(dest)
-	if err != nil {
-		return fmt.Errorf("read blob index: %w", err)
+		CreatedAt:        time.Now(),
+		SnapshotMetadata: meta,
 	}
 
 	ctx := &snapshotContext{
-		relPath:           snapshot.CreatedAt.UTC().Format("20060102T150405Z"),
-		dest:              dest,
 		snapshot:          snapshot,
-		existingBlobIDs:   existingBlobs,
 		referencedBlobIDs: make(map[BlobID]blobLen),
-		uploadedBlobIDs:   make(map[BlobID]blobLen),
 	}
 
+	dests, errs := snapshotter.backupSet.OpenDestinations()
+	// the mirror below wraps the same destinations, so they are only closed here
+	defer closeDestinations(dests)
+	for i, dest := range dests {
+		target := &snapshotTarget{
+			name:            fmt.Sprintf("%d (%s)", i+1, snapshotter.backupSet.conf.Destinations[i]),
+			dest:            dest,
+			uploadedBlobIDs: make(map[BlobID]blobLen),
+		}
+		ctx.targets = append(ctx.targets, target)
+		if errs[i] != nil {
+			target.fail(fmt.Errorf("init destination: %w", errs[i]))
+			continue
+		}
+
+		lock, err := lockRepository(dest, LockShared, "backup")
+		if err != nil {
+			target.fail(fmt.Errorf("lock repository: %w", err))
+			continue
+		}
+		target.lock = lock
+
+		existingBlobs, err := snapshotter.backupSet.ReadBlobIndex(dest)
+		if err != nil {
+			target.fail(fmt.Errorf("read blob index: %w", err))
+			continue
+		}
+		target.existingBlobIDs = existingBlobs
+	}
+	defer func() {
+		for _, target := range ctx.targets {
+			if target.lock != nil {
+				if err := target.lock.Unlock(); err != nil {
+					fmt.Println("WARN: destination", target.name+":", err)
+				}
+			}
+		}
+	}()
+	if len(ctx.activeTargets()) == 0 {
+		return snapshotter.targetErrors(ctx)
+	}
+
+	key, err := snapshotter.openSharedRepositoryKey(ctx)
+	if err != nil {
+		return fmt.Errorf("open repository key: %w", err)
+	}
+
+	encoder, err := newBlobEncoder(key, snapshotter.backupSet.conf.Compression)
+	if err != nil {
+		return err
+	}
+	ctx.encoder = encoder
+
+	chunkerParams, err := snapshotter.openSharedChunkerParams(ctx)
+	if err != nil {
+		return fmt.Errorf("open chunker params: %w", err)
+	}
+	ctx.chunkerParams = chunkerParams
+	ctx.gearTable = newGearTable(chunkerParams.Seed, key)
+
+	activeDests := make([]destination.Interface, 0)
+	for _, target := range ctx.activeTargets() {
+		activeDests = append(activeDests, target.dest)
+	}
+	if len(activeDests) == 0 {
+		return snapshotter.targetErrors(ctx)
+	}
+	mirror, err := destination.NewMirror(activeDests)
+	if err != nil {
+		return err
+	}
+	ctx.dest = mirror
+
 	previousSnapshot, err := GetLatestSnapshot(ctx)
 	if err != nil {
 		return fmt.Errorf("get previous snapshot: %w", err)
 	}
 	ctx.previousSnapshot = previousSnapshot
 	if ctx.previousSnapshot != nil {
+		if err := ctx.previousSnapshot.loadFiles(ctx.dest, ctx.encoder.key); err != nil {
+			return fmt.Errorf("read previous snapshot: %w", err)
+		}
+		snapshot.Parent = ctx.previousSnapshot.Name
 		fmt.Println("previous snapshot was", ctx.previousSnapshot.CreatedAt)
 	} else {
 		fmt.Println("no previous snapshot found")
@@ -116,10 +291,19 @@ func (snapshotter *snapshotter) TakeSnapshot() error {
 	if err := snapshotter.uploadBlobs(ctx); err != nil {
 		return fmt.Errorf("upload blobs: %w", err)
 	}
-	fmt.Println("uploaded", len(ctx.uploadedBlobIDs), "blobs of total", len(ctx.referencedBlobIDs), "referenced")
 
-	if err := snapshot.WriteIndex(ctx); err != nil {
-		return fmt.Errorf("write snapshot index: %w", err)
+	if err := snapshotter.writeTrees(ctx); err != nil {
+		return fmt.Errorf("write trees: %w", err)
+	}
+
+	index, err := snapshot.assignName()
+	if err != nil {
+		return fmt.Errorf("encode snapshot index: %w", err)
+	}
+	for _, target := range ctx.activeTargets() {
+		if err := snapshot.WriteIndex(target.dest, index); err != nil {
+			target.fail(fmt.Errorf("write snapshot index: %w", err))
+		}
 	}
 
 	/*
@@ -139,15 +323,127 @@ func (snapshotter *snapshotter) TakeSnapshot() error {
 				-> on blob = 16 bytes IV + 16mb encrypted data (+ aes padding)
 	*/
 
-	if err := snapshotter.UpdateBlobIndex(ctx); err != nil {
-		return fmt.Errorf("update blob index: %w", err)
+	for _, target := range ctx.activeTargets() {
+		if err := snapshotter.UpdateBlobIndex(ctx, target); err != nil {
+			target.fail(fmt.Errorf("update blob index: %w", err))
+			continue
+		}
+		fmt.Println("destination", target.name+":", "uploaded", len(target.uploadedBlobIDs), "blobs of total", len(ctx.referencedBlobIDs), "referenced")
 	}
 
-	return nil
+	return snapshotter.targetErrors(ctx)
+}
+
+// openSharedRepositoryKey opens the repository key of the first destination that has one, or initializes it on the first destination. The key file is copied to all other destinations, because blobs are only encrypted once for all of them.
+func (snapshotter *snapshotter) openSharedRepositoryKey(ctx *snapshotContext) (*repositoryKey, error) {
+	source, err := ctx.findTargetWithFile(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := snapshotter.backupSet.openRepositoryKey(source.dest, true)
+	if err != nil || key == nil {
+		return key, err
+	}
+
+	data, err := source.dest.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	ctx.distributeRepositoryFile(source, keyFilePath, data, func(target *snapshotTarget) error {
+		if len(target.existingBlobIDs) > 0 {
+			return fmt.Errorf("encryption is enabled, but destination already contains unencrypted blobs")
+		}
+		return nil
+	})
+	return key, nil
+}
+
+// openSharedChunkerParams opens the chunker parameters of the first destination that has them and copies them to all other destinations, so that blobs are identical everywhere.
+func (snapshotter *snapshotter) openSharedChunkerParams(ctx *snapshotContext) (chunkerParams, error) {
+	source, err := ctx.findTargetWithFile(chunkerParamsPath)
+	if err != nil {
+		return chunkerParams{}, err
+	}
+	params, err := snapshotter.backupSet.openChunkerParams(source.dest, source.existingBlobIDs)
+	if err != nil {
+		return chunkerParams{}, err
+	}
+
+	data, err := writeChunkerParams(params)
+	if err != nil {
+		return chunkerParams{}, err
+	}
+	ctx.distributeRepositoryFile(source, chunkerParamsPath, data, nil)
+	return params, nil
+}
+
+// findTargetWithFile returns the first active target that contains the given file, or the first active target if none does.
+func (ctx *snapshotContext) findTargetWithFile(relPath string) (*snapshotTarget, error) {
+	for _, target := range ctx.activeTargets() {
+		exists, err := target.dest.FileExists(relPath)
+		if err != nil {
+			target.fail(fmt.Errorf("check %s: %w", relPath, err))
+			continue
+		}
+		if exists {
+			return target, nil
+		}
+	}
+	targets := ctx.activeTargets()
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("all destinations failed")
+	}
+	return targets[0], nil
+}
+
+// distributeRepositoryFile writes a repository file to all active targets except source. Targets that already contain a different file, or that are rejected by check, are failed.
+func (ctx *snapshotContext) distributeRepositoryFile(source *snapshotTarget, relPath string, data []byte, check func(target *snapshotTarget) error) {
+	for _, target := range ctx.activeTargets() {
+		if target == source {
+			continue
+		}
+
+		existing, err := target.dest.ReadFile(relPath)
+		if err == nil {
+			if !bytes.Equal(existing, data) {
+				target.fail(fmt.Errorf("%s differs from destination %s", relPath, source.name))
+			}
+			continue
+		}
+		if !target.dest.IsNotExists(err) {
+			target.fail(fmt.Errorf("read %s: %w", relPath, err))
+			continue
+		}
+
+		if check != nil {
+			if err := check(target); err != nil {
+				target.fail(err)
+				continue
+			}
+		}
+		if err := target.dest.WriteFile(relPath, data); err != nil {
+			target.fail(fmt.Errorf("write %s: %w", relPath, err))
+		}
+	}
 }
 
+// targetErrors returns the combined errors of all failed targets.
+func (snapshotter *snapshotter) targetErrors(ctx *snapshotContext) error {
+	var errs []error
+	for _, target := range ctx.targets {
+		if target.err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.name, target.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gatherFiles collects all regular files, directories and symlinks below the source path. Other file types like sockets or devices are skipped.
 func (snapshotter *snapshotter) gatherFiles(ctx *snapshotContext) error {
 	ctx.snapshot.Files = make(map[string]FileSnapshot)
+	owners := newFileOwnerLookup()
+	// hardlinks maps inodes with multiple links to the first path found
+	hardlinks := make(map[fileInode]string)
 	return filepath.Walk(snapshotter.backupSet.conf.Source.Path, func(path string, fi fs.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -155,26 +451,80 @@ func (snapshotter *snapshotter) gatherFiles(ctx *snapshotContext) error {
 
 		//TODO skip dir with return ErrSkipDir
 
-		if !fi.IsDir() {
-			//TODO skip files
-			relPath := strings.ReplaceAll(strings.TrimLeft(path[len(snapshotter.backupSet.conf.Source.Path):], "/\\"), "\\", "/")
-			ctx.snapshot.Files[relPath] = FileSnapshot{
-				Path:         relPath,
-				LastModified: fi.ModTime(),
-				Size:         uint64(fi.Size()),
-			}
+		relPath := strings.ReplaceAll(strings.TrimLeft(path[len(snapshotter.backupSet.conf.Source.Path):], "/\\"), "\\", "/")
+		if len(relPath) == 0 {
+			// the source dir itself
+			return nil
+		}
+		//TODO skip files
+		file := FileSnapshot{
+			Path:         relPath,
+			LastModified: fi.ModTime(),
+			Mode:         fi.Mode(),
+			Owner:        owners.Get(fi),
+		}
+		switch {
+		case fi.Mode().IsRegular():
+			file.Size = uint64(fi.Size())
 			ctx.snapshot.TotalSize += uint64(fi.Size())
+			if inode, ok := hardlinkInode(fi); ok {
+				if target, ok := hardlinks[inode]; ok {
+					file.HardlinkTarget = target
+				} else {
+					hardlinks[inode] = relPath
+				}
+			}
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			file.LinkTarget = target
+		case fi.IsDir():
+		default:
+			fmt.Println("WARN: skipping", relPath+":", "unsupported file type", fi.Mode().Type())
+			return nil
+		}
+		xattrs, err := listXattrs(path)
+		if err != nil {
+			return fmt.Errorf("read extended attributes of %q: %w", relPath, err)
 		}
+		file.Xattrs = xattrs
+		ctx.snapshot.Files[relPath] = file
 		return nil
 	})
 }
 
 func (snapshotter *snapshotter) uploadBlobs(ctx *snapshotContext) error {
-	for relPath := range ctx.snapshot.Files {
+	for relPath, file := range ctx.snapshot.Files {
+		if err := snapshotter.storeLargeXattrs(ctx, relPath); err != nil {
+			return fmt.Errorf("store extended attributes of %q: %w", relPath, err)
+		}
+		if !file.IsRegular() || len(file.HardlinkTarget) > 0 {
+			continue
+		}
 		if err := snapshotter.uploadBlobsOfFile(ctx, relPath); err != nil {
 			return fmt.Errorf("upload file blobs of %q: %w", relPath, err)
 		}
 	}
+	// further links share the content of the first file of their group
+	return ctx.snapshot.resolveHardlinks()
+}
+
+// resolveHardlinks copies Size and Blobs of the first file of each hardlink group to the other files of the group.
+func (snapshot *Snapshot) resolveHardlinks() error {
+	for relPath, file := range snapshot.Files {
+		if len(file.HardlinkTarget) == 0 {
+			continue
+		}
+		target, ok := snapshot.Files[file.HardlinkTarget]
+		if !ok || !target.IsRegular() || len(target.HardlinkTarget) > 0 {
+			return fmt.Errorf("invalid hardlink target %q of %q", file.HardlinkTarget, relPath)
+		}
+		file.Size = target.Size
+		file.Blobs = target.Blobs
+		snapshot.Files[relPath] = file
+	}
 	return nil
 }
 
@@ -183,87 +533,156 @@ func (snapshotter *snapshotter) uploadBlobsOfFile(ctx *snapshotContext, relPath
 
 	if ctx.previousSnapshot != nil {
 		if previousFile, ok := ctx.previousSnapshot.Files[relPath]; ok {
-			if previousFile.LastModified.UnixMilli() == file.LastModified.UnixMilli() {
-				file.Blobs = make([]BlobID, 0, len(previousFile.Blobs))
-				for _, blobID := range previousFile.Blobs {
-					file.Blobs = append(file.Blobs, blobID)
-					if blobLen, ok := ctx.existingBlobIDs[blobID]; ok {
-						ctx.referencedBlobIDs[blobID] = blobLen
-					} else {
-						//TODO upload missing blobs
-						return fmt.Errorf("file %q is unchanged, but blobs in dest are missing", relPath)
+			// files of version 0 indexes only have a precision of milliseconds and are read once again after an upgrade
+			if previousFile.IsRegular() && previousFile.LastModified.Equal(file.LastModified) && previousFile.Size == file.Size {
+				if blobLens, ok := ctx.findBlobsOnAllTargets(previousFile.Blobs); ok {
+					file.Blobs = make([]BlobID, 0, len(previousFile.Blobs))
+					for i, blobID := range previousFile.Blobs {
+						file.Blobs = append(file.Blobs, blobID)
+						ctx.referencedBlobIDs[blobID] = blobLens[i]
 					}
+					ctx.snapshot.Files[relPath] = file
+					return nil
 				}
-				ctx.snapshot.Files[relPath] = file
-				return nil
+				// blobs are missing on some destination, read the file again to upload them
 			}
 		}
 	}
 
-	buf := make([]byte, blobSize)
-
 	path := filepath.Join(snapshotter.backupSet.conf.Source.Path, strings.ReplaceAll(relPath, "/", string(filepath.Separator)))
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	file.Blobs = make([]BlobID, 0, file.Size/blobSize+1)
-	for i := uint64(0); i < file.Size; i += blobSize {
-		remainingSize := file.Size - i
-		readLen := min(blobSize, remainingSize)
-		if _, err := io.ReadFull(f, buf[:readLen]); err != nil {
+	chunker := newChunker(io.LimitReader(snapshotter.readLimiter.Reader(f), int64(file.Size)), ctx.chunkerParams, ctx.gearTable)
+
+	file.Blobs = make([]BlobID, 0)
+	var totalLen uint64
+	for {
+		chunk, err := chunker.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
 			return err
 		}
+		readLen := len(chunk)
+		totalLen += uint64(readLen)
 
-		blob, err := snapshotter.prepareBlob(ctx, buf[:readLen])
+		blob, err := snapshotter.prepareBlob(ctx, chunk)
 		if err != nil {
 			return err
 		}
 		file.Blobs = append(file.Blobs, blob.ID)
 		ctx.referencedBlobIDs[blob.ID] = blobLen(readLen)
 
-		if _, ok := ctx.existingBlobIDs[blob.ID]; !ok {
-			if err := snapshotter.WriteBlob(ctx, blob); err != nil {
-				return err
-			}
-			ctx.uploadedBlobIDs[blob.ID] = blobLen(readLen)
+		if err := snapshotter.writeBlobToTargets(ctx, blob); err != nil {
+			return err
 		}
 	}
+	if totalLen != file.Size {
+		return fmt.Errorf("file changed during backup: read %d bytes, but expected %d", totalLen, file.Size)
+	}
 	ctx.snapshot.Files[relPath] = file
 	return nil
 }
 
-func (snapshotter *snapshotter) prepareBlob(_ *snapshotContext, content []byte) (*blob, error) {
-	hash := sha256.Sum256(content)
+func (snapshotter *snapshotter) prepareBlob(ctx *snapshotContext, content []byte) (*blob, error) {
 	return &blob{
-		ID:      hash,
+		ID:      ctx.encoder.key.blobID(content),
 		Content: content,
 	}, nil
 }
 
 func (snapshot *Snapshot) GetBlobDir(id BlobID) string {
+	return getBlobDir(id)
+}
+
+func (snapshot *Snapshot) GetBlobPath(id BlobID) string {
+	return getBlobPath(id)
+}
+
+func getBlobDir(id BlobID) string {
 	blobIDStr := id.String()
 	return ".blobs/" + blobIDStr[0:2] + "/" + blobIDStr[2:4] + "/" + blobIDStr[4:6] + "/" + blobIDStr[6:8]
 }
 
-func (snapshot *Snapshot) GetBlobPath(id BlobID) string {
+func getBlobPath(id BlobID) string {
 	blobIDStr := id.String()
-	return snapshot.GetBlobDir(id) + "/" + blobIDStr[8:]
+	return getBlobDir(id) + "/" + blobIDStr[8:]
+}
+
+// findBlobsOnAllTargets returns the lengths of the given blobs if all active targets contain them.
+func (ctx *snapshotContext) findBlobsOnAllTargets(blobIDs []BlobID) ([]blobLen, bool) {
+	blobLens := make([]blobLen, 0, len(blobIDs))
+	for _, blobID := range blobIDs {
+		var length blobLen
+		for _, target := range ctx.activeTargets() {
+			l, ok := target.existingBlobIDs[blobID]
+			if !ok {
+				if l, ok = target.uploadedBlobIDs[blobID]; !ok {
+					return nil, false
+				}
+			}
+			length = l
+		}
+		blobLens = append(blobLens, length)
+	}
+	return blobLens, true
 }
 
-func (snapshotter *snapshotter) WriteBlob(ctx *snapshotContext, blob *blob) error {
-	blobDir := ctx.previousSnapshot.GetBlobDir(blob.ID)
-	blobPath := ctx.snapshot.GetBlobPath(blob.ID)
-	if err := ctx.dest.CreateDir(blobDir); err != nil {
+// writeBlobToTargets writes the blob to all active targets that do not contain it yet. It only fails if no target is left.
+func (snapshotter *snapshotter) writeBlobToTargets(ctx *snapshotContext, blob *blob) error {
+	var data []byte
+	for _, target := range ctx.activeTargets() {
+		if target.hasBlob(blob.ID) {
+			continue
+		}
+		if data == nil {
+			encoded, err := ctx.encoder.encode(blob.ID, blob.Content)
+			if err != nil {
+				return err
+			}
+			data = encoded
+		}
+		if err := snapshotter.WriteBlob(target.dest, blob.ID, data); err != nil {
+			target.fail(fmt.Errorf("write blob %s: %w", blob.ID, err))
+			continue
+		}
+		target.uploadedBlobIDs[blob.ID] = blobLen(len(blob.Content))
+	}
+	if len(ctx.activeTargets()) == 0 {
+		return fmt.Errorf("all destinations failed")
+	}
+	return nil
+}
+
+func (snapshotter *snapshotter) WriteBlob(dest destination.Interface, id BlobID, data []byte) error {
+	if err := dest.CreateDir(getBlobDir(id)); err != nil {
 		return err
 	}
-	//TODO encrypt
-	return ctx.dest.WriteFile(blobPath, blob.Content)
+	f, err := dest.OpenWriter(getBlobPath(id))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		destination.Abort(f)
+		return err
+	}
+	return f.Close()
 }
 
-func (snapshotter *snapshotter) UpdateBlobIndex(ctx *snapshotContext) error {
-	blobs, err := snapshotter.backupSet.ReadBlobIndex(ctx.dest)
+// UpdateBlobIndex adds the referenced blobs to the blob index of the target. Concurrent backups wait for each other, so no update gets lost.
+func (snapshotter *snapshotter) UpdateBlobIndex(ctx *snapshotContext, target *snapshotTarget) error {
+	lock, err := lockBlobIndex(target.dest, "backup")
+	if err != nil {
+		return fmt.Errorf("lock blob index: %w", err)
+	}
+	defer lock.Unlock()
+
+	blobs, err := snapshotter.backupSet.ReadBlobIndex(target.dest)
 	if err != nil {
 		return err
 	}
@@ -272,47 +691,155 @@ func (snapshotter *snapshotter) UpdateBlobIndex(ctx *snapshotContext) error {
 		blobs[id] = blobLen
 	}
 
-	return snapshotter.backupSet.WriteBlobIndex(ctx.dest, blobs)
+	return snapshotter.backupSet.WriteBlobIndex(target.dest, blobs)
 }
 
-func (snapshot *Snapshot) WriteIndex(ctx *snapshotContext) error {
-	w := bytes.NewBuffer(nil)
+// assignName encodes the snapshot index and names the snapshot by its ID. The encoded index is returned to be written with WriteIndex. Tags can be changed later, so they are left out of the index and written next to it.
+func (snapshot *Snapshot) assignName() ([]byte, error) {
+	indexed := *snapshot
+	indexed.Tags = nil
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := indexed.writeIndex(w); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	snapshot.Name = snapshotID(buf.Bytes())
+	return buf.Bytes(), nil
+}
 
-	// version
-	if err := w.WriteByte(0); err != nil {
+// WriteIndex writes the encoded index and the tags of the snapshot to dest. The index is written last, because snapshots without index are ignored.
+func (snapshot *Snapshot) WriteIndex(dest destination.Interface, index []byte) error {
+	if len(snapshot.Tags) > 0 {
+		if err := snapshot.writeTags(dest); err != nil {
+			return fmt.Errorf("write tags: %w", err)
+		}
+	}
+	return dest.WriteFile(snapshot.Name+"/.snapshot", index)
+}
+
+// Versions of the snapshot index. Version 0 only contains regular files with a precision of milliseconds.
+const (
+	snapshotIndexV0 = 0
+	// snapshotIndexV1 adds directories, symlinks, file modes, owners and nanosecond modification times.
+	snapshotIndexV1 = 1
+	// snapshotIndexV2 adds extended attributes.
+	snapshotIndexV2 = 2
+	// snapshotIndexV3 adds hardlinks.
+	snapshotIndexV3 = 3
+	// snapshotIndexV4 adds the snapshot metadata.
+	snapshotIndexV4 = 4
+	// snapshotIndexV5 stores the creation time with nanoseconds. Snapshots of this version are named by their ID.
+	snapshotIndexV5 = 5
+	// snapshotIndexV6 replaces the entries by the root tree. Snapshots without root tree are still written as version 5.
+	snapshotIndexV6 = 6
+)
+
+func (snapshot *Snapshot) writeIndex(w *bufio.Writer) error {
+	version := byte(snapshotIndexV6)
+	if snapshot.Tree == nil {
+		version = snapshotIndexV5
+	}
+	if err := w.WriteByte(version); err != nil {
 		return err
 	}
 
-	if err := binary.Write(w, binary.LittleEndian, uint64(snapshot.CreatedAt.Unix())); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, snapshot.CreatedAt.UnixNano()); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, snapshot.TotalSize); err != nil {
 		return err
 	}
+	if err := writeSnapshotMetadata(w, snapshot.SnapshotMetadata); err != nil {
+		return err
+	}
+	if snapshot.Tree != nil {
+		if err := binary.Write(w, binary.LittleEndian, uint32(snapshot.FileCount)); err != nil {
+			return err
+		}
+		_, err := w.Write(snapshot.Tree[:])
+		return err
+	}
 	if err := binary.Write(w, binary.LittleEndian, uint32(len(snapshot.Files))); err != nil {
 		return err
 	}
-	for _, f := range snapshot.Files {
-		if err := writeStr(w, f.Path); err != nil {
+	for _, path := range sortedPaths(snapshot.Files) {
+		if err := writeFileEntry(w, snapshot.Files[path]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeFileEntry(w *bufio.Writer, f FileSnapshot) error {
+	if err := writeStr(w, f.Path); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(f.Mode)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, f.LastModified.UnixNano()); err != nil {
+		return err
+	}
+
+	if f.Owner == nil {
+		if err := w.WriteByte(0); err != nil {
+			return err
+		}
+	} else {
+		if err := w.WriteByte(1); err != nil {
 			return err
 		}
-		if err := binary.Write(w, binary.LittleEndian, uint64(f.LastModified.UnixMilli())); err != nil {
+		if err := binary.Write(w, binary.LittleEndian, [2]uint32{f.Owner.UID, f.Owner.GID}); err != nil {
 			return err
 		}
-		if err := binary.Write(w, binary.LittleEndian, f.Size); err != nil {
+		if err := writeStr(w, f.Owner.User); err != nil {
 			return err
 		}
-		if err := binary.Write(w, binary.LittleEndian, uint32(len(f.Blobs))); err != nil {
+		if err := writeStr(w, f.Owner.Group); err != nil {
 			return err
 		}
-		for _, blobID := range f.Blobs {
-			if _, err := w.Write(blobID[:]); err != nil {
+	}
+
+	if err := writeXattrs(w, f.Xattrs); err != nil {
+		return err
+	}
+
+	switch {
+	case f.IsSymlink():
+		return writeStr(w, f.LinkTarget)
+	case f.IsRegular():
+		if len(f.HardlinkTarget) > 0 {
+			if err := w.WriteByte(1); err != nil {
 				return err
 			}
+			return writeStr(w, f.HardlinkTarget)
 		}
+		if err := w.WriteByte(0); err != nil {
+			return err
+		}
+		return writeFileContent(w, f)
 	}
+	return nil
+}
 
-	return ctx.dest.WriteFile(snapshot.CreatedAt.UTC().Format("20060102T150405Z/.snapshot"), w.Bytes())
+// writeFileContent writes size and blobs of a regular file.
+func writeFileContent(w *bufio.Writer, f FileSnapshot) error {
+	if err := binary.Write(w, binary.LittleEndian, f.Size); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(f.Blobs))); err != nil {
+		return err
+	}
+	for _, blobID := range f.Blobs {
+		if _, err := w.Write(blobID[:]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ReadSnapshotIndex(ctx *snapshotContext, path string) (*Snapshot, error) {
@@ -327,9 +854,13 @@ func ReadSnapshotIndex(ctx *snapshotContext, path string) (*Snapshot, error) {
 	if err != nil {
 		return nil, err
 	}
-	if version != 0 {
+	if version > snapshotIndexV6 {
 		return nil, fmt.Errorf("unsupported snapshot version %d", version)
 	}
+	// snapshots named by their ID must match it
+	if name := pathpkg.Dir(path); isSnapshotID(name) && snapshotID(data) != name {
+		return nil, fmt.Errorf("index does not match snapshot ID %s", name)
+	}
 
 	snapshot := &Snapshot{}
 
@@ -337,53 +868,268 @@ func ReadSnapshotIndex(ctx *snapshotContext, path string) (*Snapshot, error) {
 	if err := binary.Read(r, binary.LittleEndian, &createdAt); err != nil {
 		return nil, err
 	}
-	snapshot.CreatedAt = time.Unix(int64(createdAt), 0)
+	if version >= snapshotIndexV5 {
+		snapshot.CreatedAt = time.Unix(0, int64(createdAt))
+	} else {
+		snapshot.CreatedAt = time.Unix(int64(createdAt), 0)
+	}
 
 	if err := binary.Read(r, binary.LittleEndian, &snapshot.TotalSize); err != nil {
 		return nil, err
 	}
+	if version >= snapshotIndexV4 {
+		if snapshot.SnapshotMetadata, err = readSnapshotMetadata(r); err != nil {
+			return nil, err
+		}
+	}
 
 	var fileCount uint32
 	if err := binary.Read(r, binary.LittleEndian, &fileCount); err != nil {
 		return nil, err
 	}
+	snapshot.FileCount = int(fileCount)
+	if version >= snapshotIndexV6 {
+		// the entries are read from the trees on demand
+		var tree BlobID
+		if _, err := io.ReadFull(r, tree[:]); err != nil {
+			return nil, err
+		}
+		snapshot.Tree = &tree
+		return snapshot, nil
+	}
 	snapshot.Files = make(map[string]FileSnapshot, fileCount)
 	for range fileCount {
 		var file FileSnapshot
-
-		path, err := readStr(r)
+		var err error
+		if version == snapshotIndexV0 {
+			file, err = readFileEntryV0(r)
+		} else {
+			file, err = readFileEntry(r, version)
+		}
 		if err != nil {
 			return nil, err
 		}
-		file.Path = path
+		snapshot.Files[file.Path] = file
+	}
+	if err := snapshot.resolveHardlinks(); err != nil {
+		return nil, err
+	}
 
-		var lastModifiedMillis uint64
-		if err := binary.Read(r, binary.LittleEndian, &lastModifiedMillis); err != nil {
-			return nil, err
+	return snapshot, nil
+}
+
+func readFileEntryV0(r *bytes.Reader) (FileSnapshot, error) {
+	file := FileSnapshot{Mode: 0644}
+
+	path, err := readStr(r)
+	if err != nil {
+		return FileSnapshot{}, err
+	}
+	file.Path = path
+
+	var lastModifiedMillis uint64
+	if err := binary.Read(r, binary.LittleEndian, &lastModifiedMillis); err != nil {
+		return FileSnapshot{}, err
+	}
+	file.LastModified = time.UnixMilli(int64(lastModifiedMillis))
+
+	if err := binary.Read(r, binary.LittleEndian, &file.Size); err != nil {
+		return FileSnapshot{}, err
+	}
+
+	file.Blobs, err = readBlobList(r)
+	if err != nil {
+		return FileSnapshot{}, err
+	}
+	return file, nil
+}
+
+// readFileEntry reads an entry of index version 1 or later.
+func readFileEntry(r *bytes.Reader, version byte) (FileSnapshot, error) {
+	var file FileSnapshot
+
+	path, err := readStr(r)
+	if err != nil {
+		return FileSnapshot{}, err
+	}
+	file.Path = path
+
+	var mode uint32
+	if err := binary.Read(r, binary.LittleEndian, &mode); err != nil {
+		return FileSnapshot{}, err
+	}
+	file.Mode = fs.FileMode(mode)
+
+	var lastModifiedNanos int64
+	if err := binary.Read(r, binary.LittleEndian, &lastModifiedNanos); err != nil {
+		return FileSnapshot{}, err
+	}
+	file.LastModified = time.Unix(0, lastModifiedNanos)
+
+	hasOwner, err := r.ReadByte()
+	if err != nil {
+		return FileSnapshot{}, err
+	}
+	if hasOwner != 0 {
+		var ids [2]uint32
+		if err := binary.Read(r, binary.LittleEndian, &ids); err != nil {
+			return FileSnapshot{}, err
+		}
+		file.Owner = &FileOwner{UID: ids[0], GID: ids[1]}
+		if file.Owner.User, err = readStr(r); err != nil {
+			return FileSnapshot{}, err
+		}
+		if file.Owner.Group, err = readStr(r); err != nil {
+			return FileSnapshot{}, err
 		}
-		file.LastModified = time.UnixMilli(int64(lastModifiedMillis))
+	}
 
+	if version >= snapshotIndexV2 {
+		if file.Xattrs, err = readXattrs(r); err != nil {
+			return FileSnapshot{}, err
+		}
+	}
+
+	switch {
+	case file.IsSymlink():
+		if file.LinkTarget, err = readStr(r); err != nil {
+			return FileSnapshot{}, err
+		}
+	case file.IsRegular():
+		if version >= snapshotIndexV3 {
+			isHardlink, err := r.ReadByte()
+			if err != nil {
+				return FileSnapshot{}, err
+			}
+			if isHardlink != 0 {
+				// size and blobs are resolved after all entries are read
+				file.HardlinkTarget, err = readStr(r)
+				if err != nil {
+					return FileSnapshot{}, err
+				}
+				return file, nil
+			}
+		}
 		if err := binary.Read(r, binary.LittleEndian, &file.Size); err != nil {
-			return nil, err
+			return FileSnapshot{}, err
+		}
+		if file.Blobs, err = readBlobList(r); err != nil {
+			return FileSnapshot{}, err
+		}
+	}
+	return file, nil
+}
+
+func writeSnapshotMetadata(w *bufio.Writer, meta SnapshotMetadata) error {
+	for _, str := range []string{meta.Hostname, meta.Username, meta.SourcePath, meta.BackupSet, meta.Version, meta.Description, meta.Parent} {
+		if err := writeStr(w, str); err != nil {
+			return err
+		}
+	}
+	return writeTags(w, meta.Tags)
+}
+
+func readSnapshotMetadata(r *bytes.Reader) (SnapshotMetadata, error) {
+	var meta SnapshotMetadata
+	for _, str := range []*string{&meta.Hostname, &meta.Username, &meta.SourcePath, &meta.BackupSet, &meta.Version, &meta.Description, &meta.Parent} {
+		var err error
+		if *str, err = readStr(r); err != nil {
+			return SnapshotMetadata{}, err
+		}
+	}
+	var err error
+	if meta.Tags, err = readTags(r); err != nil {
+		return SnapshotMetadata{}, err
+	}
+	return meta, nil
+}
+
+func writeXattrs(w *bufio.Writer, xattrs []Xattr) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(xattrs))); err != nil {
+		return err
+	}
+	for _, xattr := range xattrs {
+		if err := writeStr(w, xattr.Name); err != nil {
+			return err
+		}
+		if xattr.Blob != nil {
+			if err := w.WriteByte(1); err != nil {
+				return err
+			}
+			if _, err := w.Write(xattr.Blob[:]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.WriteByte(0); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(xattr.Value))); err != nil {
+			return err
+		}
+		if _, err := w.Write(xattr.Value); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		var blobCount uint32
-		if err := binary.Read(r, binary.LittleEndian, &blobCount); err != nil {
+func readXattrs(r *bytes.Reader) ([]Xattr, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	xattrs := make([]Xattr, 0, count)
+	for range count {
+		name, err := readStr(r)
+		if err != nil {
+			return nil, err
+		}
+		inBlob, err := r.ReadByte()
+		if err != nil {
 			return nil, err
 		}
-		file.Blobs = make([]BlobID, 0, blobCount)
-		for range blobCount {
+		if inBlob != 0 {
 			var blobID BlobID
-			if err := binary.Read(r, binary.LittleEndian, &blobID); err != nil {
+			if _, err := io.ReadFull(r, blobID[:]); err != nil {
 				return nil, err
 			}
-			file.Blobs = append(file.Blobs, blobID)
+			xattrs = append(xattrs, Xattr{Name: name, Blob: &blobID})
+			continue
 		}
-
-		snapshot.Files[path] = file
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		if int64(length) > int64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: name, Value: value})
 	}
+	return xattrs, nil
+}
 
-	return snapshot, nil
+func readBlobList(r *bytes.Reader) ([]BlobID, error) {
+	var blobCount uint32
+	if err := binary.Read(r, binary.LittleEndian, &blobCount); err != nil {
+		return nil, err
+	}
+	blobs := make([]BlobID, 0, blobCount)
+	for range blobCount {
+		var blobID BlobID
+		if err := binary.Read(r, binary.LittleEndian, &blobID); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blobID)
+	}
+	return blobs, nil
 }
 
 func ListSnapshots(ctx *snapshotContext) ([]*Snapshot, error) {
@@ -394,8 +1140,7 @@ func ListSnapshots(ctx *snapshotContext) ([]*Snapshot, error) {
 	snapshots := make([]*Snapshot, 0)
 	for _, fi := range files {
 		if fi.IsDir {
-			_, err := time.Parse("20060102T150405Z", fi.Name)
-			if err != nil {
+			if !isSnapshotDirName(fi.Name) {
 				continue
 			}
 			if exists, err := ctx.dest.FileExists(fi.Name + "/.snapshot"); err != nil || !exists {
@@ -406,12 +1151,57 @@ func ListSnapshots(ctx *snapshotContext) ([]*Snapshot, error) {
 			if err != nil {
 				return nil, err
 			}
+			snapshot.Name = fi.Name
+			if err := snapshot.readTags(ctx.dest); err != nil {
+				return nil, fmt.Errorf("read tags of snapshot %s: %w", snapshot.ShortName(), err)
+			}
 			snapshots = append(snapshots, snapshot)
 		}
 	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
 	return snapshots, nil
 }
 
+// isSnapshotDirName reports whether name is a snapshot ID, or the creation time of a snapshot taken before snapshots were named by their ID.
+func isSnapshotDirName(name string) bool {
+	if isSnapshotID(name) {
+		return true
+	}
+	_, err := time.Parse("20060102T150405Z", name)
+	return err == nil
+}
+
+// snapshotID returns the hex SHA-256 of an encoded snapshot index.
+func snapshotID(index []byte) string {
+	sum := sha256.Sum256(index)
+	return hex.EncodeToString(sum[:])
+}
+
+func isSnapshotID(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	for _, chr := range name {
+		if (chr < '0' || chr > '9') && (chr < 'a' || chr > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotShortNameLen is the length of abbreviated snapshot IDs.
+const snapshotShortNameLen = 8
+
+// ShortName returns the snapshot ID abbreviated to 8 characters. Names of older snapshots are returned unchanged.
+func (snapshot *Snapshot) ShortName() string {
+	if isSnapshotID(snapshot.Name) {
+		return snapshot.Name[:snapshotShortNameLen]
+	}
+	return snapshot.Name
+}
+
 func GetLatestSnapshot(ctx *snapshotContext) (*Snapshot, error) {
 	snapshots, err := ListSnapshots(ctx)
 	if err != nil {
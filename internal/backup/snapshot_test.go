@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIndex(t *testing.T) {
+	dest := must(destination.NewLocalDir(destination.LocalDirConfig{Path: t.TempDir()}))
+	ctx := &snapshotContext{dest: dest}
+
+	t.Run("V5", func(t *testing.T) {
+		snapshot := &Snapshot{
+			CreatedAt: time.Unix(1700000000, 0),
+			TotalSize: 5,
+			SnapshotMetadata: SnapshotMetadata{
+				Hostname:    "host",
+				Username:    "me",
+				SourcePath:  "/home/me",
+				BackupSet:   "home",
+				Version:     "v1.0.0",
+				Tags:        []string{"a", "b"},
+				Description: "a test",
+				Parent:      "20231114T221320Z",
+			},
+			Files: map[string]FileSnapshot{
+				"dir":          {Path: "dir", Mode: fs.ModeDir | 0750, LastModified: time.Unix(1700000000, 1)},
+				"dir/file.txt": {Path: "dir/file.txt", Mode: 0600, Size: 5, Blobs: []BlobID{{1}}, LastModified: time.Unix(1700000000, 123456789), Owner: &FileOwner{UID: 1000, GID: 100, User: "me", Group: "users"}, Xattrs: []Xattr{{Name: "user.a", Value: []byte("small")}, {Name: "user.b", Blob: &BlobID{2}}, {Name: "user.empty", Value: []byte{}}}},
+				"link":         {Path: "link", Mode: fs.ModeSymlink | 0777, LinkTarget: "dir/file.txt", LastModified: time.Unix(1700000000, 0)},
+				"dir/linked":   {Path: "dir/linked", Mode: 0600, Size: 5, Blobs: []BlobID{{1}}, HardlinkTarget: "dir/file.txt", LastModified: time.Unix(1700000000, 123456789)},
+			},
+		}
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		require.NoError(t, snapshot.writeIndex(w))
+		require.NoError(t, w.Flush())
+		require.NoError(t, dest.WriteFile("current", buf.Bytes()))
+
+		read := must(ReadSnapshotIndex(ctx, "current"))
+		require.Equal(t, snapshot.TotalSize, read.TotalSize)
+		require.Equal(t, snapshot.SnapshotMetadata, read.SnapshotMetadata)
+		require.Len(t, read.Files, 4)
+		for path, file := range snapshot.Files {
+			readFile := read.Files[path]
+			require.True(t, file.LastModified.Equal(readFile.LastModified))
+			readFile.LastModified = file.LastModified
+			require.Equal(t, file, readFile)
+		}
+	})
+
+	t.Run("V0", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.WriteByte(0)
+		binary.Write(&buf, binary.LittleEndian, uint64(1700000000))
+		binary.Write(&buf, binary.LittleEndian, uint64(5))
+		binary.Write(&buf, binary.LittleEndian, uint32(1))
+		buf.WriteString("dir/file.txt\x00")
+		binary.Write(&buf, binary.LittleEndian, uint64(1700000000123))
+		binary.Write(&buf, binary.LittleEndian, uint64(5))
+		binary.Write(&buf, binary.LittleEndian, uint32(1))
+		buf.Write(make([]byte, 32))
+		require.NoError(t, dest.WriteFile("v0", buf.Bytes()))
+
+		read := must(ReadSnapshotIndex(ctx, "v0"))
+		require.Equal(t, map[string]FileSnapshot{
+			"dir/file.txt": {Path: "dir/file.txt", Mode: 0644, Size: 5, Blobs: []BlobID{{}}, LastModified: time.UnixMilli(1700000000123)},
+		}, read.Files)
+	})
+}
+
+func TestSnapshotIDs(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "first file", time.Now())
+
+	backupSet := newTestBackupSet(t, srcDir)
+	first := takeTestSnapshot(t, backupSet)
+	second := takeTestSnapshot(t, backupSet)
+	require.True(t, isSnapshotID(first.Name))
+	require.True(t, isSnapshotID(second.Name))
+	require.NotEqual(t, first.Name, second.Name)
+	require.Equal(t, first.Name[:snapshotShortNameLen], first.ShortName())
+
+	dest := must(backupSet.OpenDestination())
+	index := must(dest.ReadFile(first.Name + "/.snapshot"))
+	require.Equal(t, first.Name, snapshotID(index))
+
+	t.Run("Prefix", func(t *testing.T) {
+		require.Equal(t, first.Name, must(backupSet.FindSnapshot(first.ShortName())).Name)
+		require.Equal(t, second.Name, must(backupSet.FindSnapshot(second.Name)).Name)
+		_, err := backupSet.FindSnapshot("xyz")
+		require.Error(t, err)
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		require.NoError(t, dest.WriteFile("20231114T221320Z/.snapshot", index))
+		snapshots := must(backupSet.ListSnapshots())
+		require.Len(t, snapshots, 3)
+		legacy := must(backupSet.FindSnapshot("20231114T221320Z"))
+		require.Equal(t, "20231114T221320Z", legacy.ShortName())
+		require.NoError(t, backupSet.ForgetSnapshots([]*Snapshot{legacy}))
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		require.NoError(t, dest.WriteFile(first.Name+"/.snapshot", append(index, 0)))
+		_, err := backupSet.ListSnapshots()
+		require.ErrorContains(t, err, "does not match snapshot ID")
+	})
+}
+
+func TestSnapshotTrees(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "a.txt", "top level", modTime)
+	writeTestFile(t, srcDir, "unchanged/x.txt", "unchanged file", modTime)
+	writeTestFile(t, srcDir, "changed/y.txt", "old content", modTime)
+
+	backupSet := newTestBackupSet(t, srcDir)
+	first := takeTestSnapshot(t, backupSet)
+	writeTestFile(t, srcDir, "changed/y.txt", "new content", modTime.Add(time.Hour))
+	second := takeTestSnapshot(t, backupSet)
+
+	require.Equal(t, 5, second.FileCount)
+	require.Equal(t, first.Files["unchanged"].Tree, second.Files["unchanged"].Tree)
+	require.NotEqual(t, first.Files["changed"].Tree, second.Files["changed"].Tree)
+	require.NotEqual(t, first.Tree, second.Tree)
+
+	dest := must(backupSet.OpenDestination())
+	listed := must(ReadSnapshotIndex(&snapshotContext{dest: dest}, second.Name+"/.snapshot"))
+	require.Equal(t, second.Tree, listed.Tree)
+	require.Nil(t, listed.Files)
+	require.NotContains(t, string(must(dest.ReadFile(second.Name+"/.snapshot"))), "x.txt")
+
+	t.Run("Browser", func(t *testing.T) {
+		browser := must(NewBrowser(backupSet, listed))
+		defer browser.Close()
+		files := must(browser.ListFiles("changed"))
+		require.Len(t, files, 1)
+		require.Equal(t, "changed/y.txt", files[0].Path)
+		require.ElementsMatch(t, []string{"changed", "unchanged"}, must(browser.ListDirs("")))
+		require.False(t, must(browser.IsDir("a.txt")))
+
+		// only the trees on the way to the listed directories are read
+		require.Len(t, browser.cache.entries, 2)
+		require.Contains(t, browser.cache.entries, *second.Files["changed"].Tree)
+		require.Equal(t, 2, browser.cache.destLoads)
+	})
+
+	t.Run("CorruptedTree", func(t *testing.T) {
+		tree := *second.Files["unchanged"].Tree
+		require.NoError(t, dest.WriteFile(getBlobPath(tree), []byte("corrupted")))
+
+		report := must(backupSet.Check(CheckOptions{}))[0]
+		require.Len(t, report.Errors, 2)
+		require.Contains(t, report.Errors[0].Message, "unreadable tree")
+
+		// blobs below an unreadable tree must not be removed
+		_, err := backupSet.Prune(false)
+		require.ErrorContains(t, err, "read trees of snapshot")
+		require.True(t, must(dest.FileExists(getBlobPath(second.Files["unchanged/x.txt"].Blobs[0]))))
+	})
+}
@@ -0,0 +1,287 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	pathpkg "path"
+	"sort"
+	"strings"
+
+	"github.com/sbreitf1/keepr/internal/backup/destination"
+)
+
+/*
+Tree object format:
+
+	version (1 byte) | entry count (uint32) | entries sorted by name
+
+A tree contains the entries of one directory of a snapshot. Entries are encoded like those of snapshot index version 5 with the name instead of the path. Directories are followed by the BlobID of their tree and hardlinks by size and blobs of their content, so every tree can be read on its own.
+Trees are stored as blobs and named by the hash of their content, so directories that did not change are shared by all snapshots that contain them.
+*/
+
+const treeV0 = 0
+
+// writeTrees writes the trees of all directories of the snapshot, children before their parents, and sets the root tree of the snapshot.
+func (snapshotter *snapshotter) writeTrees(ctx *snapshotContext) error {
+	snapshot := ctx.snapshot
+	children := map[string][]string{"": nil}
+	for path, file := range snapshot.Files {
+		if file.IsDir() {
+			if _, ok := children[path]; !ok {
+				children[path] = nil
+			}
+		}
+		parent := parentPath(path)
+		children[parent] = append(children[parent], path)
+	}
+
+	dirs := make([]string, 0, len(children))
+	for dir := range children {
+		if len(dir) > 0 && !snapshot.Files[dir].IsDir() {
+			return fmt.Errorf("missing directory entry %q", dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	// the root has depth 0, its subdirectories depth 1
+	depth := func(dir string) int {
+		if len(dir) == 0 {
+			return 0
+		}
+		return strings.Count(dir, "/") + 1
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return depth(dirs[i]) > depth(dirs[j])
+	})
+
+	for _, dir := range dirs {
+		paths := children[dir]
+		sort.Strings(paths)
+		entries := make([]FileSnapshot, 0, len(paths))
+		for _, path := range paths {
+			entries = append(entries, snapshot.Files[path])
+		}
+		content, err := encodeTree(entries)
+		if err != nil {
+			return fmt.Errorf("encode tree of %q: %w", dir, err)
+		}
+
+		blob, err := snapshotter.prepareBlob(ctx, content)
+		if err != nil {
+			return err
+		}
+		if err := snapshotter.writeBlobToTargets(ctx, blob); err != nil {
+			return err
+		}
+		ctx.referencedBlobIDs[blob.ID] = blobLen(len(content))
+
+		id := blob.ID
+		if len(dir) == 0 {
+			snapshot.Tree = &id
+			continue
+		}
+		file := snapshot.Files[dir]
+		file.Tree = &id
+		snapshot.Files[dir] = file
+	}
+	snapshot.FileCount = len(snapshot.Files)
+	return nil
+}
+
+// parentPath returns the path of the directory containing path, which is empty for the snapshot root.
+func parentPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func joinPath(dir, name string) string {
+	if len(dir) == 0 {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// encodeTree encodes the entries of one directory. Entries must be sorted by name and directories must have a tree.
+func encodeTree(entries []FileSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := w.WriteByte(treeV0); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(entries))); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		entry.Path = pathpkg.Base(entry.Path)
+		if err := writeFileEntry(w, entry); err != nil {
+			return nil, err
+		}
+		switch {
+		case entry.IsDir():
+			if entry.Tree == nil {
+				return nil, fmt.Errorf("directory %q has no tree", entry.Path)
+			}
+			if _, err := w.Write(entry.Tree[:]); err != nil {
+				return nil, err
+			}
+		case entry.IsRegular() && len(entry.HardlinkTarget) > 0:
+			if err := writeFileContent(w, entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeTree returns the entries of a tree. The paths of the entries only contain their names.
+func decodeTree(data []byte) ([]FileSnapshot, error) {
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != treeV0 {
+		return nil, fmt.Errorf("unsupported tree version %d", version)
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	entries := make([]FileSnapshot, 0, min(int(count), r.Len()))
+	for range count {
+		entry, err := readFileEntry(r, snapshotIndexV5)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry.Path) == 0 || entry.Path == "." || entry.Path == ".." || strings.Contains(entry.Path, "/") {
+			return nil, fmt.Errorf("invalid entry name %q", entry.Path)
+		}
+		switch {
+		case entry.IsDir():
+			var tree BlobID
+			if _, err := io.ReadFull(r, tree[:]); err != nil {
+				return nil, err
+			}
+			entry.Tree = &tree
+		case entry.IsRegular() && len(entry.HardlinkTarget) > 0:
+			if err := binary.Read(r, binary.LittleEndian, &entry.Size); err != nil {
+				return nil, err
+			}
+			if entry.Blobs, err = readBlobList(r); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// findTreeEntry returns the entry with the given name from entries of a decoded tree.
+func findTreeEntry(entries []FileSnapshot, name string) (FileSnapshot, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Path >= name
+	})
+	if i < len(entries) && entries[i].Path == name {
+		return entries[i], true
+	}
+	return FileSnapshot{}, false
+}
+
+// readTree reads the tree id from dest and verifies it against its BlobID.
+func readTree(dest destination.Interface, key *repositoryKey, id BlobID) ([]FileSnapshot, error) {
+	data, err := dest.ReadFile(getBlobPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("read tree %s: %w", id, err)
+	}
+	content, err := decodeBlob(key, id, data)
+	if err != nil {
+		return nil, err
+	}
+	if key.blobID(content) != id {
+		return nil, fmt.Errorf("tree %s is corrupted", id)
+	}
+	entries, err := decodeTree(content)
+	if err != nil {
+		return nil, fmt.Errorf("decode tree %s: %w", id, err)
+	}
+	return entries, nil
+}
+
+// loadFiles reads all entries of a snapshot with root tree into Files. Older snapshots already contain them.
+func (snapshot *Snapshot) loadFiles(dest destination.Interface, key *repositoryKey) error {
+	if snapshot.Files != nil || snapshot.Tree == nil {
+		return nil
+	}
+	files := make(map[string]FileSnapshot, snapshot.FileCount)
+	if err := readTreeFiles(dest, key, *snapshot.Tree, "", files); err != nil {
+		return err
+	}
+	snapshot.Files = files
+	return nil
+}
+
+// readTreeFiles adds all entries below the tree of the directory dir to files.
+func readTreeFiles(dest destination.Interface, key *repositoryKey, id BlobID, dir string, files map[string]FileSnapshot) error {
+	entries, err := readTree(dest, key, id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.Path = joinPath(dir, entry.Path)
+		files[entry.Path] = entry
+		if entry.IsDir() {
+			if err := readTreeFiles(dest, key, *entry.Tree, entry.Path, files); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// treeWalker visits the trees of several snapshots. Trees shared by snapshots are only read once.
+type treeWalker struct {
+	dest destination.Interface
+	key  *repositoryKey
+	// sizes contains the total size of the regular files below every visited tree.
+	sizes map[BlobID]uint64
+}
+
+func newTreeWalker(dest destination.Interface, key *repositoryKey) *treeWalker {
+	return &treeWalker{dest: dest, key: key, sizes: make(map[BlobID]uint64)}
+}
+
+// walk calls visit for the tree id and all trees below it that were not visited before. It returns the total size of the regular files below id.
+func (walker *treeWalker) walk(id BlobID, visit func(id BlobID, entries []FileSnapshot)) (uint64, error) {
+	if size, ok := walker.sizes[id]; ok {
+		return size, nil
+	}
+	entries, err := readTree(walker.dest, walker.key, id)
+	if err != nil {
+		return 0, err
+	}
+	visit(id, entries)
+
+	var size uint64
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			subSize, err := walker.walk(*entry.Tree, visit)
+			if err != nil {
+				return 0, err
+			}
+			size += subSize
+		case entry.IsRegular():
+			size += entry.Size
+		}
+	}
+	walker.sizes[id] = size
+	return size, nil
+}
@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+)
+
+// xattrInlineSize is the largest value stored in the snapshot index. Larger values are stored as blobs, so big attributes do not bloat the index.
+const xattrInlineSize = 1024
+
+// Xattr is an extended attribute of a file. POSIX ACLs are stored as the attributes system.posix_acl_access and system.posix_acl_default.
+type Xattr struct {
+	Name string
+	// Value is nil if the value is stored as blob.
+	Value []byte
+	// Blob contains the value if it is larger than xattrInlineSize.
+	Blob *BlobID
+}
+
+// storeLargeXattrs moves values larger than xattrInlineSize of the file at relPath into blobs.
+func (snapshotter *snapshotter) storeLargeXattrs(ctx *snapshotContext, relPath string) error {
+	file := ctx.snapshot.Files[relPath]
+	for i, xattr := range file.Xattrs {
+		if len(xattr.Value) <= xattrInlineSize {
+			continue
+		}
+		blob, err := snapshotter.prepareBlob(ctx, xattr.Value)
+		if err != nil {
+			return err
+		}
+		if err := snapshotter.writeBlobToTargets(ctx, blob); err != nil {
+			return err
+		}
+		ctx.referencedBlobIDs[blob.ID] = blobLen(len(xattr.Value))
+		file.Xattrs[i] = Xattr{Name: xattr.Name, Blob: &blob.ID}
+	}
+	return nil
+}
+
+// readXattrs returns the extended attributes of file. Values stored as blobs are loaded from the repository.
+func (browser *Browser) readXattrs(file FileSnapshot) ([]Xattr, error) {
+	xattrs := make([]Xattr, 0, len(file.Xattrs))
+	for _, xattr := range file.Xattrs {
+		if xattr.Blob != nil {
+			value, err := browser.readVerifiedBlob(*xattr.Blob)
+			if err != nil {
+				return nil, fmt.Errorf("read value of %s: %w", xattr.Name, err)
+			}
+			xattr = Xattr{Name: xattr.Name, Value: value}
+		}
+		xattrs = append(xattrs, xattr)
+	}
+	return xattrs, nil
+}
+
+// restoreXattrs sets the extended attributes of the restored file at path. Attributes that are not supported by the target file system or need privileges are skipped with a warning.
+func (browser *Browser) restoreXattrs(path string, file FileSnapshot) error {
+	if len(file.Xattrs) == 0 {
+		return nil
+	}
+	xattrs, err := browser.readXattrs(file)
+	if err != nil {
+		return err
+	}
+	for _, xattr := range xattrs {
+		if err := setXattr(path, xattr.Name, xattr.Value); err != nil {
+			if isXattrUnsupported(err) {
+				fmt.Println("WARN: cannot restore attribute", xattr.Name, "of", file.Path+":", err)
+				continue
+			}
+			return fmt.Errorf("set attribute %s: %w", xattr.Name, err)
+		}
+	}
+	return nil
+}
+
+func sortXattrs(xattrs []Xattr) {
+	sort.Slice(xattrs, func(i, j int) bool {
+		return xattrs[i].Name < xattrs[j].Name
+	})
+}
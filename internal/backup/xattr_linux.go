@@ -0,0 +1,74 @@
+//go:build linux
+
+package backup
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs reads all extended attributes of path without following symlinks. File systems without support for extended attributes have none.
+func listXattrs(path string) ([]Xattr, error) {
+	names, err := readXattrBuffer(func(buf []byte) (int, error) {
+		return unix.Llistxattr(path, buf)
+	})
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var xattrs []Xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := readXattrBuffer(func(buf []byte) (int, error) {
+			return unix.Lgetxattr(path, string(name), buf)
+		})
+		if err != nil {
+			if errors.Is(err, unix.ENODATA) {
+				// removed in the meantime
+				continue
+			}
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: string(name), Value: value})
+	}
+	sortXattrs(xattrs)
+	return xattrs, nil
+}
+
+// readXattrBuffer calls f with a buffer of the size it reports for a nil buffer. The size is queried again if the value grew in between.
+func readXattrBuffer(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		n, err := f(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// isXattrUnsupported reports whether an attribute cannot be read or written because of the file system or missing privileges.
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM)
+}
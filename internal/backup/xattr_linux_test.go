@@ -0,0 +1,84 @@
+//go:build linux
+
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// testACL returns a POSIX ACL in the format of system.posix_acl_access that grants uid read access.
+func testACL(uid uint32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	for _, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{
+		{0x01, 6, 0xffffffff}, // user::rw-
+		{0x02, 4, uid},        // user:<uid>:r--
+		{0x04, 4, 0xffffffff}, // group::r--
+		{0x10, 4, 0xffffffff}, // mask::r--
+		{0x20, 0, 0xffffffff}, // other::---
+	} {
+		binary.Write(&buf, binary.LittleEndian, entry)
+	}
+	return buf.Bytes()
+}
+
+func TestXattrs(t *testing.T) {
+	srcDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	writeTestFile(t, srcDir, "tagged.txt", "tagged file", modTime)
+	writeTestFile(t, srcDir, "large.txt", "large attribute", modTime)
+	writeTestFile(t, srcDir, "shared.txt", "shared file", modTime)
+	err := unix.Lsetxattr(filepath.Join(srcDir, "tagged.txt"), "user.keepr.test", []byte("some value"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("temp dir does not support extended attributes")
+	}
+	require.NoError(t, err)
+	largeValue := bytes.Repeat([]byte("x"), 2*xattrInlineSize)
+	require.NoError(t, unix.Lsetxattr(filepath.Join(srcDir, "large.txt"), "user.keepr.large", largeValue, 0))
+	acl := testACL(4242)
+	hasACL := unix.Lsetxattr(filepath.Join(srcDir, "shared.txt"), "system.posix_acl_access", acl, 0) == nil
+
+	backupSet := newTestBackupSet(t, srcDir)
+	snapshot := takeTestSnapshot(t, backupSet)
+	require.Equal(t, []Xattr{{Name: "user.keepr.test", Value: []byte("some value")}}, snapshot.Files["tagged.txt"].Xattrs)
+	largeXattrs := snapshot.Files["large.txt"].Xattrs
+	require.Len(t, largeXattrs, 1)
+	require.Nil(t, largeXattrs[0].Value)
+	require.NotNil(t, largeXattrs[0].Blob)
+	require.Contains(t, snapshot.Files["large.txt"].ReferencedBlobs(), *largeXattrs[0].Blob)
+
+	// the blob of the large value is still referenced
+	must(backupSet.Prune(false))
+
+	browser := must(NewBrowser(backupSet, snapshot))
+	defer browser.Close()
+
+	t.Run("Restore", func(t *testing.T) {
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{Xattrs: true}))
+		requireTestFile(t, targetDir, "large.txt", "large attribute", modTime)
+		require.Equal(t, []Xattr{{Name: "user.keepr.test", Value: []byte("some value")}}, must(listXattrs(filepath.Join(targetDir, "tagged.txt"))))
+		require.Equal(t, []Xattr{{Name: "user.keepr.large", Value: largeValue}}, must(listXattrs(filepath.Join(targetDir, "large.txt"))))
+		if hasACL {
+			require.Contains(t, must(listXattrs(filepath.Join(targetDir, "shared.txt"))), Xattr{Name: "system.posix_acl_access", Value: acl})
+		}
+	})
+
+	t.Run("WithoutFlag", func(t *testing.T) {
+		targetDir := t.TempDir()
+		require.NoError(t, browser.Restore(targetDir, RestoreOptions{}))
+		require.Empty(t, must(listXattrs(filepath.Join(targetDir, "tagged.txt"))))
+	})
+}
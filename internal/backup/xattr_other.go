@@ -0,0 +1,20 @@
+//go:build !linux
+
+package backup
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this system")
+
+// listXattrs reports no attributes, because they are only supported on Linux.
+func listXattrs(path string) ([]Xattr, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, errXattrUnsupported)
+}
@@ -19,7 +19,7 @@ func LoadBackupSets() ([]*backup.BackupSet, error) {
 	configDir := getConfigDir()
 
 	//TODO print error
-	os.MkdirAll(configDir, os.ModePerm)
+	os.MkdirAll(configDir, 0700)
 
 	data, err := os.ReadFile(filepath.Join(configDir, "backupsets.json"))
 	if err != nil {
@@ -50,7 +50,7 @@ func LoadBackupSets() ([]*backup.BackupSet, error) {
 func WriteBackupSets(sets []*backup.BackupSet) error {
 	configDir := getConfigDir()
 
-	if err := os.MkdirAll(configDir, os.ModePerm); err != nil {
+	if err := os.MkdirAll(configDir, 0700); err != nil {
 		return fmt.Errorf("create config dir: %w", err)
 	}
 
@@ -59,5 +59,6 @@ func WriteBackupSets(sets []*backup.BackupSet) error {
 		return err
 	}
 
-	return os.WriteFile(filepath.Join(configDir, "backupsets.json"), data, os.ModePerm)
+	// the config contains destination credentials
+	return os.WriteFile(filepath.Join(configDir, "backupsets.json"), data, 0600)
 }
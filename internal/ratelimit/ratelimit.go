@@ -0,0 +1,184 @@
+// Package ratelimit limits the throughput of readers and writers, optionally depending on the time of day.
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize limits the bytes passed to the underlying reader or writer at once, so the throughput stays smooth.
+const chunkSize = 32 << 10
+
+// Limiter is a token bucket shared by all readers and writers created from it. It allows bursts of up to one second of data. A nil limiter does not limit anything.
+type Limiter struct {
+	mu sync.Mutex
+	// rate returns the allowed bytes per second at the given time. A rate of 0 is unlimited.
+	rate   func(time.Time) int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewLimiter returns a limiter for the given rate, which may change over time.
+func NewLimiter(rate func(time.Time) int64) *Limiter {
+	return &Limiter{rate: rate, now: time.Now, sleep: time.Sleep}
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		l.mu.Unlock()
+		return
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	}
+	l.last = now
+	// tokens may become negative, later callers then wait until the debt is paid
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// Reader limits reads from r.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+// ReadCloser limits reads from rc.
+func (l *Limiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return &readCloser{reader: reader{r: rc, l: l}, c: rc}
+}
+
+// Writer limits writes to w.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{w: w, l: l}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:min(len(p), chunkSize)])
+	r.l.Wait(n)
+	return n, err
+}
+
+type readCloser struct {
+	reader
+	c io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	return rc.c.Close()
+}
+
+type writer struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunkSize)]
+		w.l.Wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Period is a time range of the day in local time. Periods that end before they start span midnight, like 22:00 to 06:00.
+type Period struct {
+	from time.Duration
+	to   time.Duration
+}
+
+// ParsePeriod parses the start and end of a period given like "22:00".
+func ParsePeriod(from, to string) (Period, error) {
+	var p Period
+	var err error
+	if p.from, err = parseTimeOfDay(from); err != nil {
+		return Period{}, fmt.Errorf("invalid From: %w", err)
+	}
+	if p.to, err = parseTimeOfDay(to); err != nil {
+		return Period{}, fmt.Errorf("invalid To: %w", err)
+	}
+	return p, nil
+}
+
+func parseTimeOfDay(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t is within the period. The start is included, the end is not.
+func (p Period) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if p.from <= p.to {
+		return offset >= p.from && offset < p.to
+	}
+	return offset >= p.from || offset < p.to
+}
+
+// ScheduledRate is the rate in bytes per second during a period.
+type ScheduledRate struct {
+	Period Period
+	Rate   int64
+}
+
+// Schedule returns the rate of the first period that contains the given time, or defaultRate outside of all periods. It returns nil if all rates are unlimited.
+func Schedule(defaultRate int64, rates []ScheduledRate) func(time.Time) int64 {
+	limited := defaultRate > 0
+	for _, r := range rates {
+		limited = limited || r.Rate > 0
+	}
+	if !limited {
+		return nil
+	}
+	return func(t time.Time) int64 {
+		for _, r := range rates {
+			if r.Period.Contains(t) {
+				return r.Rate
+			}
+		}
+		return defaultRate
+	}
+}
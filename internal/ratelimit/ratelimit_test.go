@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(rate func(time.Time) int64) (*Limiter, *time.Time, *time.Duration) {
+	l := NewLimiter(rate)
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+	var slept time.Duration
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return l, &now, &slept
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("Rate", func(t *testing.T) {
+		l, _, slept := newTestLimiter(func(time.Time) int64 { return 1000 })
+		// the first second of data is allowed as burst
+		for range 10 {
+			l.Wait(500)
+		}
+		require.Equal(t, 4*time.Second, *slept)
+	})
+
+	t.Run("Burst", func(t *testing.T) {
+		l, now, slept := newTestLimiter(func(time.Time) int64 { return 1000 })
+		l.Wait(1000)
+		// idle time is only saved up to one second of data
+		*now = now.Add(time.Minute)
+		l.Wait(3000)
+		require.Equal(t, 2*time.Second, *slept)
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		l, _, slept := newTestLimiter(func(time.Time) int64 { return 0 })
+		l.Wait(1 << 30)
+		require.Zero(t, *slept)
+
+		var nilLimiter *Limiter
+		nilLimiter.Wait(1 << 30)
+		r := bytes.NewReader(nil)
+		require.Same(t, r, nilLimiter.Reader(r))
+	})
+
+	t.Run("ReaderWriter", func(t *testing.T) {
+		l, _, slept := newTestLimiter(func(time.Time) int64 { return 64 << 10 })
+		data := bytes.Repeat([]byte("x"), 256<<10)
+		var buf bytes.Buffer
+		n, err := io.Copy(l.Writer(&buf), l.Reader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.Equal(t, data, buf.Bytes())
+		// read and written once each, minus the initial burst
+		require.Equal(t, 7*time.Second, *slept)
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	night, err := ParsePeriod("22:00", "06:00")
+	require.NoError(t, err)
+	lunch, err := ParsePeriod("12:00", "13:30")
+	require.NoError(t, err)
+	rate := Schedule(1000, []ScheduledRate{{Period: night, Rate: 0}, {Period: lunch, Rate: 5000}})
+
+	at := func(hour, min int) time.Time {
+		return time.Date(2025, 3, 1, hour, min, 0, 0, time.Local)
+	}
+	require.Equal(t, int64(0), rate(at(23, 0)))
+	require.Equal(t, int64(0), rate(at(5, 59)))
+	require.Equal(t, int64(1000), rate(at(6, 0)))
+	require.Equal(t, int64(5000), rate(at(12, 0)))
+	require.Equal(t, int64(1000), rate(at(13, 30)))
+
+	require.Nil(t, Schedule(0, []ScheduledRate{{Period: night, Rate: 0}}))
+
+	_, err = ParsePeriod("22:00", "6am")
+	require.ErrorContains(t, err, "invalid To")
+}
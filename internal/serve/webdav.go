@@ -15,14 +15,14 @@ import (
 	"golang.org/x/net/webdav"
 )
 
-func ServeWebDAV(browser *backup.Browser) error {
+func ServeWebDAV(browser *backup.Browser, addr string) error {
 	var handler webdav.Handler
 	handler.FileSystem = &webDAVFS{browser: browser}
 	handler.LockSystem = webdav.NewMemLS()
 	handler.Logger = func(r *http.Request, err error) {
 		//fmt.Println("DAV:", r.Method, r.URL, "->", err)
 	}
-	return http.ListenAndServe("127.0.0.1:8080", &handler)
+	return http.ListenAndServe(addr, &handler)
 }
 
 type webDAVFS struct {
@@ -115,7 +115,7 @@ func (wfs *webDAVFS) newDAVFileInfoForFile(file backup.FileSnapshot) *davFileInf
 	return &davFileInfo{
 		name:    wfs.browser.FileName(file.Path),
 		size:    int64(file.Size),
-		mode:    0644,
+		mode:    file.Mode.Perm(),
 		modTime: file.LastModified,
 		isDir:   false,
 	}